@@ -13,6 +13,7 @@ var Directives = []string{
 	"root",
 	"metadata",
 	"geoip",
+	"tsmetadata",
 	"cancel",
 	"tls",
 	"proxyproto",
@@ -44,6 +45,7 @@ var Directives = []string{
 	"cache",
 	"rewrite",
 	"acl",
+	"tsacl",
 	"header",
 	"dnssec",
 	"autopath",
@@ -71,5 +73,6 @@ var Directives = []string{
 	"view",
 	"nomad",
 	"tailscale",
+	"tsbind",
 	"tsproxy",
 }
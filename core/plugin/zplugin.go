@@ -61,7 +61,10 @@ import (
 	_ "github.com/coredns/coredns/plugin/tls"
 	_ "github.com/coredns/coredns/plugin/trace"
 	_ "github.com/coredns/coredns/plugin/transfer"
+	_ "github.com/coredns/coredns/plugin/tsacl"
+	_ "github.com/coredns/coredns/plugin/tsbind"
 	_ "github.com/coredns/coredns/plugin/tsig"
+	_ "github.com/coredns/coredns/plugin/tsmetadata"
 	_ "github.com/coredns/coredns/plugin/tsnames"
 	_ "github.com/coredns/coredns/plugin/tsproxy"
 	_ "github.com/coredns/coredns/plugin/view"
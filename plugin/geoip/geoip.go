@@ -72,6 +72,31 @@ func newGeoIP(dbPath string, edns0 bool) (*GeoIP, error) {
 	return &GeoIP{db: db, edns0: edns0}, nil
 }
 
+// Open opens the database at dbPath for lookups outside of the plugin chain, e.g. by plugins
+// that filter connections by the country of their source.
+func Open(dbPath string) (*GeoIP, error) {
+	return newGeoIP(dbPath, false)
+}
+
+// Close closes the database opened by Open. It must not be used afterwards.
+func (g GeoIP) Close() error {
+	return g.db.Close()
+}
+
+// CountryCode returns the ISO code of the country ip is located in. It is empty if the database
+// does not know the address or does not provide the city schema.
+func (g GeoIP) CountryCode(ip netip.Addr) string {
+	if g.db.provides&city == 0 {
+		return ""
+	}
+	data, err := g.db.City(ip)
+	if err != nil {
+		log.Debugf("Country lookup of %s failed due to database lookup error: %v", ip, err)
+		return ""
+	}
+	return data.Country.ISOCode
+}
+
 // ServeDNS implements the plugin.Handler interface.
 func (g GeoIP) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	return plugin.NextOrFailure(pluginName, g.Next, ctx, w, r)
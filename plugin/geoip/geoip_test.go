@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/netip"
+	"path/filepath"
 	"testing"
 
 	"github.com/coredns/coredns/plugin/metadata"
@@ -139,3 +141,25 @@ func testMetadata(t *testing.T, state request.Request, geoIP *GeoIP, label, expe
 			label, expectedValue, value)
 	}
 }
+
+func TestCountryCode(t *testing.T) {
+	tests := []struct {
+		dbPath   string
+		ip       string
+		expected string
+	}{
+		{cityDBPath, "81.2.69.142", "GB"},
+		{cityDBPath, "203.0.113.1", ""},
+		{asnDBPath, "81.2.69.142", ""},
+	}
+	for _, tc := range tests {
+		geoIP, err := Open(tc.dbPath)
+		if err != nil {
+			t.Fatalf("unable to open database: %v", err)
+		}
+		defer geoIP.Close()
+		if got := geoIP.CountryCode(netip.MustParseAddr(tc.ip)); got != tc.expected {
+			t.Errorf("CountryCode(%s) in %s = %q, want %q", tc.ip, filepath.Base(tc.dbPath), got, tc.expected)
+		}
+	}
+}
@@ -186,6 +186,12 @@ type node struct {
 type replacer []node
 
 func parseFormat(s string) replacer {
+	return parse(s, labels, true)
+}
+
+// parse splits s into the labels of the given set, metadata labels if
+// metadata is set, and the literals between them.
+func parse(s string, labels map[string]struct{}, metadata bool) replacer {
 	// Assume there is a literal between each label - its cheaper to over
 	// allocate once than allocate twice.
 	rep := make(replacer, 0, strings.Count(s, "{")*2)
@@ -212,7 +218,7 @@ func parseFormat(s string) replacer {
 		switch _, ok := labels[val]; {
 		case ok:
 			typ = typeLabel
-		case strings.HasPrefix(val, "{/"):
+		case metadata && strings.HasPrefix(val, "{/"):
 			// Strip "{/}" from metadata labels
 			val = val[2 : len(val)-1]
 			typ = typeMetadata
@@ -262,6 +268,46 @@ var bufPool = sync.Pool{
 	},
 }
 
+// Custom replaces a set of labels of its own in strings, for formats that
+// describe something else than a DNS request. A Custom is safe for concurrent
+// use.
+type Custom struct {
+	labels map[string]struct{}
+	cache  sync.Map // map[string]replacer
+}
+
+// NewCustom makes a replacer for the given labels, e.g. "{remote}".
+func NewCustom(labels ...string) *Custom {
+	c := &Custom{labels: make(map[string]struct{}, len(labels))}
+	for _, l := range labels {
+		c.labels[l] = struct{}{}
+	}
+	return c
+}
+
+// Replace returns s with every label replaced by what value appends for it.
+// Other placeholders, metadata ones included, are left as is.
+func (c *Custom) Replace(s string, value func(b []byte, label string) []byte) string {
+	v, ok := c.cache.Load(s)
+	if !ok {
+		v, _ = c.cache.LoadOrStore(s, parse(s, c.labels, false))
+	}
+
+	p := bufPool.Get().(*[]byte)
+	b := *p
+	for _, n := range v.(replacer) {
+		if n.typ == typeLabel {
+			b = value(b, n.value)
+		} else {
+			b = append(b, n.value...)
+		}
+	}
+	s = string(b)
+	*p = b[:0]
+	bufPool.Put(p)
+	return s
+}
+
 func (r replacer) Replace(ctx context.Context, state request.Request, rr *dnstest.Recorder) string {
 	p := bufPool.Get().(*[]byte)
 	b := *p
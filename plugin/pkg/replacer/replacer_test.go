@@ -209,6 +209,30 @@ func TestParseFormatNodes(t *testing.T) {
 	}
 }
 
+func TestCustom(t *testing.T) {
+	c := NewCustom("{remote}", "{target}")
+	value := func(b []byte, label string) []byte {
+		if label == "{remote}" {
+			return append(b, "192.0.2.1"...)
+		}
+		return append(b, EmptyValue...)
+	}
+	for format, want := range map[string]string{
+		"{remote} -> {target}": "192.0.2.1 -> -",
+		"{ {remote} } {type}":  "{ 192.0.2.1 } {type}",
+		"{/meta} {remote}":     "{/meta} 192.0.2.1",
+		"A } {remote}{remote}": "A } 192.0.2.1192.0.2.1",
+		"no labels":            "no labels",
+	} {
+		// Twice, the second time from the cache.
+		for range 2 {
+			if got := c.Replace(format, value); got != want {
+				t.Errorf("Replace(%q) = %q, want %q", format, got, want)
+			}
+		}
+	}
+}
+
 func TestLabels(t *testing.T) {
 	w := dnstest.NewRecorder(&test.ResponseWriter{})
 	r := new(dns.Msg)
@@ -0,0 +1,136 @@
+package tailscale
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/caddy"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+// busBackoffMin/busBackoffMax bound the reconnect backoff for the IPN bus
+// watcher. tailscaled can accept a watch connection and then immediately drop
+// the stream (e.g. while it recomputes the netmap around a node change). An
+// unthrottled reconnect loop in that window spins a CPU core and allocates
+// connection/decode garbage faster than the GC can reclaim it; under a tight
+// cgroup memory limit the runtime then gets OOM-killed even though the live
+// heap stays small.
+const (
+	busBackoffMin = 1 * time.Second
+	busBackoffMax = 1 * time.Minute
+)
+
+// nextBusBackoff doubles the current backoff, saturating at busBackoffMax.
+func nextBusBackoff(cur time.Duration) time.Duration {
+	next := cur * 2
+	if next > busBackoffMax {
+		return busBackoffMax
+	}
+	return next
+}
+
+// startedKey stores the functions to run once an instance started.
+type startedKey struct{}
+
+// OnStarted registers fn to run once the instance c sets up has started, at
+// the first startup or when a reload completed. Unlike OnStartup it never
+// runs for an instance whose reload fails later on: caddy doesn't shut those
+// down, so watchers they started would be left behind.
+func OnStarted(c *caddy.Controller, fn func()) {
+	fns, _ := c.Get(startedKey{}).([]func())
+	c.Set(startedKey{}, append(fns, fn))
+}
+
+// startedHook runs the OnStarted functions of an instance that started.
+func startedHook(event caddy.EventName, info any) error {
+	if event != caddy.InstanceStartupEvent {
+		return nil
+	}
+	inst := info.(*caddy.Instance)
+	inst.StorageMu.RLock()
+	fns, _ := inst.Storage[startedKey{}].([]func())
+	inst.StorageMu.RUnlock()
+	for _, fn := range fns {
+		fn()
+	}
+	return nil
+}
+
+// WatchNetMap watches the Tailscale IPN Bus and calls fn for every netmap update, starting with the current one.
+// This function returns only when ctx is done, so plugins cancel it on shutdown to not leak watchers across
+// reloads. If it is unable to read from the IPN Bus, it will continue to retry and call reconnect (if non-nil)
+// before every retry.
+func (b *TailscalePlugin) WatchNetMap(ctx context.Context, fn func(*netmap.NetworkMap), reconnect func()) {
+	backoff := busBackoffMin
+	for {
+		watcher, err := b.Client.WatchIPNBus(ctx, ipn.NotifyInitialNetMap)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warningf("unable to connect to Tailscale event bus: %v; retrying in %s", err, backoff)
+			if reconnect != nil {
+				reconnect()
+			}
+			if !sleepCtx(ctx, backoff) {
+				return
+			}
+			backoff = nextBusBackoff(backoff)
+			continue
+		}
+
+		connectedAt := time.Now()
+		for {
+			n, err := watcher.Next()
+			if err != nil {
+				// Stream errored mid-flight. Close and reconnect — but the
+				// reconnect MUST back off (see busBackoffMin/Max): tailscaled
+				// can drop the stream the instant after accepting it, and an
+				// unthrottled retry here spins the CPU and exhausts memory.
+				// Don't `defer` the Close — the outer loop runs until ctx is
+				// done, so deferred closes would pile up until then.
+				watcher.Close()
+				break
+			}
+			if ctx.Err() != nil {
+				watcher.Close()
+				return
+			}
+			if n.NetMap != nil {
+				fn(n.NetMap)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A watcher that stayed up comfortably longer than the cap is healthy,
+		// so reset the backoff; rapid flapping keeps escalating it toward the cap.
+		if time.Since(connectedAt) > busBackoffMax {
+			backoff = busBackoffMin
+		}
+		log.Warningf("Tailscale event bus disconnected after %s; reconnecting in %s", time.Since(connectedAt).Round(time.Millisecond), backoff)
+		if reconnect != nil {
+			reconnect()
+		}
+		if !sleepCtx(ctx, backoff) {
+			return
+		}
+		backoff = nextBusBackoff(backoff)
+	}
+}
+
+// sleepCtx waits for d and reports whether ctx is still live afterwards.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
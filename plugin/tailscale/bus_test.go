@@ -0,0 +1,56 @@
+package tailscale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestNextBusBackoff(t *testing.T) {
+	// Starting from the minimum, the backoff doubles each step and then
+	// saturates at the cap — it must never exceed busBackoffMax, otherwise a
+	// reconnect storm would not be throttled.
+	cur := busBackoffMin
+	want := []time.Duration{
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		32 * time.Second,
+		busBackoffMax, // 64s would exceed the 60s cap
+		busBackoffMax,
+	}
+	for i, w := range want {
+		cur = nextBusBackoff(cur)
+		if cur != w {
+			t.Fatalf("step %d: nextBusBackoff = %s, want %s", i, cur, w)
+		}
+	}
+	if got := nextBusBackoff(busBackoffMax); got != busBackoffMax {
+		t.Errorf("nextBusBackoff(max) = %s, want %s (must stay capped)", got, busBackoffMax)
+	}
+}
+
+func TestOnStarted(t *testing.T) {
+	c := caddy.NewTestController("dns", "")
+	var ran []int
+	OnStarted(c, func() { ran = append(ran, 1) })
+	OnStarted(c, func() { ran = append(ran, 2) })
+
+	inst := &caddy.Instance{Storage: map[any]any{startedKey{}: c.Get(startedKey{})}}
+	// Other events don't start anything.
+	if err := startedHook(caddy.ShutdownEvent, inst); err != nil || len(ran) != 0 {
+		t.Fatalf("ran %v on shutdown, want nothing", ran)
+	}
+	if err := startedHook(caddy.InstanceStartupEvent, inst); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || ran[0] != 1 || ran[1] != 2 {
+		t.Errorf("ran %v, want [1 2]", ran)
+	}
+	// An instance without any doesn't mind.
+	if err := startedHook(caddy.InstanceStartupEvent, &caddy.Instance{Storage: map[any]any{}}); err != nil {
+		t.Error(err)
+	}
+}
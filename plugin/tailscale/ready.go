@@ -0,0 +1,47 @@
+package tailscale
+
+import (
+	"context"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// readyTimeout bounds the status query of a single readiness check.
+const readyTimeout = 2 * time.Second
+
+// Ready reports whether the Tailscale backend is running.
+func (b *TailscalePlugin) Ready() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), readyTimeout)
+	defer cancel()
+
+	status, err := b.Client.StatusWithoutPeers(ctx)
+	if err != nil {
+		log.Debugf("readiness check failed: %v", err)
+		return false
+	}
+	return status.BackendState == "Running"
+}
+
+// handler puts the tailscale plugin in the plugin chain of its server block,
+// so the ready plugin can find it. It passes every query on.
+type handler struct {
+	next plugin.Handler
+}
+
+// ServeDNS implements plugin.Handler.
+func (h handler) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	return plugin.NextOrFailure(h.Name(), h.next, ctx, w, r)
+}
+
+// Name implements plugin.Handler.
+func (h handler) Name() string { return "tailscale" }
+
+// Ready implements the ready.Readiness interface. After the final shutdown
+// there is no connection left, which is not ready.
+func (h handler) Ready() bool {
+	t := GetGlobalTailscale()
+	return t != nil && t.Ready()
+}
@@ -2,6 +2,9 @@ package tailscale
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
@@ -10,24 +13,65 @@ import (
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
 )
 
 var log = clog.NewWithPlugin("tailscale")
 
+// defaultHostname is the tailnet hostname of the embedded node when none is given.
+const defaultHostname = "coredns"
+
 func init() {
 	plugin.Register("tailscale", setup)
+	caddy.RegisterEventHook("tailscale", startedHook)
+}
+
+// options holds the parsed tailscale block.
+type options struct {
+	hostname  string
+	embedded  bool
+	authKey   string
+	stateDir  string
+	ephemeral bool
+	// userspace dials TCP through the local API of the host tailscaled.
+	userspace bool
+
+	// startupTimeout limits the wait for the backend, zero waits forever.
+	// When it elapses, setup fails unless startupContinue is set.
+	startupTimeout  time.Duration
+	startupContinue bool
 }
 
 func setup(c *caddy.Controller) error {
 	log.Info("initializing tailscale plugin...")
 
-	// Global instance of the tailscale plugin
-	SetGlobalTailscale(NewTailscalePlugin())
+	opts, err := parse(c)
+	if err != nil {
+		return plugin.Error("tailscale", err)
+	}
+
+	// Global instance of the tailscale plugin, shared with the instance being
+	// reloaded, if any.
+	p, err := acquireGlobalTailscale(opts)
+	if err != nil {
+		return plugin.Error("tailscale", err)
+	}
+	c.OnFinalShutdown(releaseGlobalTailscale)
+	// A reload keeps the connection, apply how it dials once it succeeded.
+	OnStarted(c, func() { p.userspace.Store(opts.userspace) })
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return handler{next: next}
+	})
 
 	// Wait for the tailscale server to properly initialize
 	log.Info("waiting for tailscale to be ready...")
+	var deadline time.Time
+	if opts.startupTimeout > 0 {
+		deadline = time.Now().Add(opts.startupTimeout)
+	}
 	for {
-		status, err := GetGlobalTailscale().Client.StatusWithoutPeers(context.Background())
+		status, err := p.Client.StatusWithoutPeers(context.Background())
 		if err != nil {
 			return err
 		}
@@ -37,6 +81,17 @@ func setup(c *caddy.Controller) error {
 			break
 		}
 
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			if !opts.startupContinue {
+				return plugin.Error("tailscale", fmt.Errorf("backend not running after %s, state is %s", opts.startupTimeout, status.BackendState))
+			}
+			// Start anyway and report not ready until the backend runs. The
+			// listen addresses can't be set anymore once the servers are up,
+			// only tsbind follows the addresses once they are known.
+			log.Warningf("tailscale backend not running after %s, state is %s; starting anyway, DNS listen addresses left unchanged", opts.startupTimeout, status.BackendState)
+			break
+		}
+
 		log.Info("waiting for tailscale")
 		time.Sleep(1 * time.Second)
 	}
@@ -44,9 +99,142 @@ func setup(c *caddy.Controller) error {
 	return nil
 }
 
+// parse reads the tailscale directive:
+//
+//	tailscale [HOSTNAME] {
+//	    tsnet
+//	    authkey_file FILE
+//	    authkey_env VAR
+//	    state_dir DIR
+//	    ephemeral
+//	    userspace
+//	    startup_timeout DURATION [fail|continue]
+//	}
+func parse(c *caddy.Controller) (*options, error) {
+	opts := &options{hostname: defaultHostname}
+	for c.Next() {
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 1:
+			opts.hostname = args[0]
+		default:
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "tsnet":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				opts.embedded = true
+			case "authkey_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				b, err := os.ReadFile(c.Val())
+				if err != nil {
+					return nil, fmt.Errorf("unable to read authkey file: %w", err)
+				}
+				opts.authKey = strings.TrimSpace(string(b))
+			case "authkey_env":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				key, ok := os.LookupEnv(c.Val())
+				if !ok {
+					return nil, fmt.Errorf("authkey environment variable %s is not set", c.Val())
+				}
+				opts.authKey = strings.TrimSpace(key)
+			case "state_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				opts.stateDir = c.Val()
+			case "ephemeral":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				opts.ephemeral = true
+			case "userspace":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				opts.userspace = true
+			case "startup_timeout":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid startup_timeout %q", args[0])
+				}
+				opts.startupTimeout = d
+				if len(args) == 2 {
+					switch args[1] {
+					case "fail":
+					case "continue":
+						opts.startupContinue = true
+					default:
+						return nil, c.Errf("unknown startup_timeout action '%s'", args[1])
+					}
+				}
+			default:
+				return nil, c.Errf("unknown property '%s'", c.Val())
+			}
+		}
+	}
+
+	if !opts.embedded && (opts.authKey != "" || opts.stateDir != "" || opts.ephemeral) {
+		return nil, fmt.Errorf("authkey, state_dir and ephemeral require tsnet mode")
+	}
+	if opts.embedded && opts.userspace {
+		return nil, fmt.Errorf("userspace requires a host tailscaled, not tsnet mode")
+	}
+
+	return opts, nil
+}
+
+// sameNode reports whether o and other describe the same Tailscale node, i.e.
+// a reload from one to the other can keep the connection.
+func (o *options) sameNode(other *options) bool {
+	if o.embedded != other.embedded {
+		return false
+	}
+	if !o.embedded {
+		return true
+	}
+	return o.hostname == other.hostname && o.authKey == other.authKey &&
+		o.stateDir == other.stateDir && o.ephemeral == other.ephemeral
+}
+
+// server builds the embedded tsnet node described by the options.
+func (o *options) server() *tsnet.Server {
+	return &tsnet.Server{
+		Hostname:  o.hostname,
+		Dir:       o.stateDir,
+		AuthKey:   o.authKey,
+		Ephemeral: o.ephemeral,
+		UserLogf:  log.Infof,
+		Logf:      log.Debugf,
+	}
+}
+
+// initialize makes the server block listen only on the node's Tailscale
+// addresses, so the gateway isn't an open resolver on its public interfaces.
+// A tsbind directive in the block is set up later and replaces them.
 func initialize(c *caddy.Controller, status *ipnstate.Status) {
 	config := dnsserver.GetConfig(c)
 
+	// The embedded node's addresses live in a userspace network stack, the
+	// host can't bind them, so keep whatever the Corefile configured.
+	if GetGlobalTailscale().Embedded() {
+		log.Info("embedded tailscale running, DNS listen addresses left unchanged")
+		return
+	}
+
 	// collect all local addresses from tailscale
 	all := make([]string, 0, len(status.TailscaleIPs))
 	for _, ip := range status.TailscaleIPs {
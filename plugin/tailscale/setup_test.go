@@ -0,0 +1,115 @@
+package tailscale
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestParse(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "authkey")
+	if err := os.WriteFile(keyFile, []byte("tskey-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TSGW_TEST_AUTHKEY", "tskey-env")
+
+	tests := []struct {
+		input     string
+		shouldErr bool
+		want      options
+	}{
+		{input: "tailscale", want: options{hostname: defaultHostname}},
+		{input: "tailscale gateway", want: options{hostname: "gateway"}},
+		{
+			input: "tailscale gateway {\n tsnet\n authkey_file " + keyFile + "\n state_dir /var/lib/coredns\n ephemeral\n}",
+			want:  options{hostname: "gateway", embedded: true, authKey: "tskey-file", stateDir: "/var/lib/coredns", ephemeral: true},
+		},
+		{
+			input: "tailscale {\n tsnet\n authkey_env TSGW_TEST_AUTHKEY\n}",
+			want:  options{hostname: defaultHostname, embedded: true, authKey: "tskey-env"},
+		},
+		{input: "tailscale {\n startup_timeout 30s\n}", want: options{hostname: defaultHostname, startupTimeout: 30 * time.Second}},
+		{input: "tailscale {\n userspace\n}", want: options{hostname: defaultHostname, userspace: true}},
+		{
+			input: "tailscale {\n startup_timeout 1m continue\n}",
+			want:  options{hostname: defaultHostname, startupTimeout: time.Minute, startupContinue: true},
+		},
+		// Error cases.
+		{input: "tailscale a b", shouldErr: true},
+		{input: "tailscale {\n tsnet yes\n}", shouldErr: true},
+		{input: "tailscale {\n state_dir /tmp\n}", shouldErr: true},
+		{input: "tailscale {\n tsnet\n authkey_env TSGW_TEST_UNSET\n}", shouldErr: true},
+		{input: "tailscale {\n tsnet\n authkey_file /nonexistent/authkey\n}", shouldErr: true},
+		{input: "tailscale {\n bogus\n}", shouldErr: true},
+		{input: "tailscale {\n userspace yes\n}", shouldErr: true},
+		{input: "tailscale {\n tsnet\n userspace\n}", shouldErr: true},
+		{input: "tailscale {\n startup_timeout\n}", shouldErr: true},
+		{input: "tailscale {\n startup_timeout soon\n}", shouldErr: true},
+		{input: "tailscale {\n startup_timeout 0s\n}", shouldErr: true},
+		{input: "tailscale {\n startup_timeout 30s retry\n}", shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		got, err := parse(c)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("test %d: expected error, got %+v", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if *got != tc.want {
+			t.Errorf("test %d: got %+v, want %+v", i, *got, tc.want)
+		}
+	}
+}
+
+func TestAcquireGlobalTailscale(t *testing.T) {
+	t.Cleanup(func() { releaseGlobalTailscale() })
+
+	p, err := acquireGlobalTailscale(&options{hostname: defaultHostname})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A reload with the same connection options reuses the connection, the
+	// hostname only matters for an embedded node.
+	again, err := acquireGlobalTailscale(&options{hostname: "other", startupTimeout: time.Minute})
+	if err != nil {
+		t.Fatalf("unexpected error on reload: %v", err)
+	}
+	if again != p {
+		t.Error("expected the reload to reuse the global tailscale plugin")
+	}
+
+	if _, err := acquireGlobalTailscale(&options{hostname: defaultHostname, embedded: true}); err != errOptionsChanged {
+		t.Errorf("expected %v when switching to tsnet, got %v", errOptionsChanged, err)
+	}
+	if GetGlobalTailscale() != p {
+		t.Error("expected a failed reload to keep the global tailscale plugin")
+	}
+
+	if err := releaseGlobalTailscale(); err != nil {
+		t.Fatalf("unexpected error on release: %v", err)
+	}
+	if GetGlobalTailscale() != nil {
+		t.Error("expected no global tailscale plugin after the final shutdown")
+	}
+}
+
+func TestHandlerReadyWithoutTailscale(t *testing.T) {
+	prev := GetGlobalTailscale()
+	SetGlobalTailscale(nil)
+	t.Cleanup(func() { SetGlobalTailscale(prev) })
+
+	if (handler{}).Ready() {
+		t.Error("Ready() = true without a tailscale connection, want false")
+	}
+}
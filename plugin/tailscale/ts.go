@@ -1,9 +1,31 @@
 package tailscale
 
-import "tailscale.com/client/local"
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"tailscale.com/client/local"
+	"tailscale.com/tsnet"
+)
 
 type TailscalePlugin struct {
 	Client *local.Client
+
+	// server is the embedded tsnet node, nil when talking to a host tailscaled.
+	server *tsnet.Server
+
+	// opts are the options the plugin was set up with, nil if it wasn't
+	// created by setup.
+	opts *options
+
+	// userspace dials TCP through the local API of the host tailscaled,
+	// see Dial. A reload may change it.
+	userspace atomic.Bool
 }
 
 func NewTailscalePlugin() *TailscalePlugin {
@@ -12,19 +34,145 @@ func NewTailscalePlugin() *TailscalePlugin {
 	}
 }
 
+// NewEmbeddedTailscalePlugin starts an in-process tsnet node and returns a plugin
+// whose Client talks to it instead of a host tailscaled.
+func NewEmbeddedTailscalePlugin(server *tsnet.Server) (*TailscalePlugin, error) {
+	if err := server.Start(); err != nil {
+		return nil, err
+	}
+
+	client, err := server.LocalClient()
+	if err != nil {
+		server.Close()
+		return nil, err
+	}
+
+	return &TailscalePlugin{
+		Client: client,
+		server: server,
+	}, nil
+}
+
 // Name implements plugin.Handler.
 func (b *TailscalePlugin) Name() string { return "tailscale" }
 
-var global *TailscalePlugin
+// Embedded reports whether the plugin runs an in-process tsnet node.
+func (b *TailscalePlugin) Embedded() bool { return b.server != nil }
+
+// Dial connects to the address on the named network. In embedded mode the
+// connection goes through the tailnet in-process, otherwise it uses the host
+// network stack. With the userspace option, TCP connections are dialed by the
+// host tailscaled through its local API instead, so tailnet addresses are
+// reachable when it runs in userspace-networking mode. The local API only
+// relays streams, UDP always uses the host network stack.
+func (b *TailscalePlugin) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	if b.server != nil {
+		return b.server.Dial(ctx, network, address)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if !b.userspace.Load() {
+			break
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port in %s: %w", address, err)
+		}
+		return b.Client.UserDial(ctx, network, host, uint16(p))
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+// Listen announces on the tailnet in embedded mode, or on the host network
+// stack otherwise.
+func (b *TailscalePlugin) Listen(network, address string) (net.Listener, error) {
+	if b.server != nil {
+		return b.server.Listen(network, address)
+	}
+	return net.Listen(network, address)
+}
+
+// ListenPacket is the packet-oriented counterpart of Listen.
+func (b *TailscalePlugin) ListenPacket(network, address string) (net.PacketConn, error) {
+	if b.server != nil {
+		return b.server.ListenPacket(network, address)
+	}
+	return net.ListenPacket(network, address)
+}
+
+// Close shuts down the embedded tsnet node, if any.
+func (b *TailscalePlugin) Close() error {
+	if b.server != nil {
+		return b.server.Close()
+	}
+	return nil
+}
+
+var (
+	globalMu sync.Mutex
+	global   *TailscalePlugin
+)
 
 func GetGlobalTailscale() *TailscalePlugin {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	return global
 }
 
+// SetGlobalTailscale replaces the global tailscale plugin. The previous one,
+// if any, is not closed.
 func SetGlobalTailscale(t *TailscalePlugin) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	global = t
+}
+
+// errOptionsChanged is returned when a reload changes how the node connects.
+var errOptionsChanged = errors.New("tailscale connection options changed, restart CoreDNS to apply them")
+
+// acquireGlobalTailscale returns the global tailscale plugin, creating it on
+// first use. Reloads run setup again and keep using the existing connection,
+// so an embedded node isn't restarted and nothing depending on it is cut off.
+func acquireGlobalTailscale(opts *options) (*TailscalePlugin, error) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
 	if global != nil {
-		panic("tailscale plugin already initialized")
+		if global.opts != nil && !global.opts.sameNode(opts) {
+			return nil, errOptionsChanged
+		}
+		return global, nil
 	}
 
-	global = t
+	p := NewTailscalePlugin()
+	if opts.embedded {
+		log.Infof("starting embedded tailscale node %q", opts.hostname)
+		var err error
+		if p, err = NewEmbeddedTailscalePlugin(opts.server()); err != nil {
+			return nil, err
+		}
+	}
+	p.opts = opts
+	p.userspace.Store(opts.userspace)
+	global = p
+	return p, nil
+}
+
+// releaseGlobalTailscale closes and forgets the global tailscale plugin. It is
+// called on final shutdown only, never on reload.
+func releaseGlobalTailscale() error {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+
+	if global == nil {
+		return nil
+	}
+	err := global.Close()
+	global = nil
+	return err
 }
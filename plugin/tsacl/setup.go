@@ -0,0 +1,171 @@
+package tsacl
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/tailscale"
+
+	"github.com/miekg/dns"
+	"tailscale.com/types/netmap"
+)
+
+const pluginName = "tsacl"
+
+func init() { plugin.Register(pluginName, setup) }
+
+func setup(c *caddy.Controller) error {
+	a, err := parse(c)
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.OnStartup(func() error {
+		ts := tailscale.GetGlobalTailscale()
+		if ts == nil {
+			return fmt.Errorf("tsacl: tailscale plugin not initialized")
+		}
+
+		a.whois.client = ts.Client
+		return nil
+	})
+	tailscale.OnStarted(c, func() {
+		go tailscale.GetGlobalTailscale().WatchNetMap(ctx, func(*netmap.NetworkMap) { a.whois.flush() }, nil)
+	})
+	c.OnShutdown(func() error {
+		cancel()
+		return nil
+	})
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		a.Next = next
+		return a
+	})
+
+	return nil
+}
+
+func parse(c *caddy.Controller) (*TSACL, error) {
+	a := &TSACL{whois: newWhoisCache(defaultCacheTTL)}
+	for c.Next() {
+		r := rule{}
+		args := c.RemainingArgs()
+		r.zones = plugin.OriginsFromArgsOrServerBlock(args, c.ServerBlockKeys)
+
+		for c.NextBlock() {
+			p := policy{}
+
+			action := strings.ToLower(c.Val())
+			switch action {
+			case "cache":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return a, c.ArgErr()
+				}
+				ttl, err := time.ParseDuration(args[0])
+				if err != nil {
+					return a, c.Errf("invalid cache duration %q: %v", args[0], err)
+				}
+				if ttl < 0 {
+					return a, c.Errf("cache duration must not be negative: %q", args[0])
+				}
+				a.whois.ttl = ttl
+				continue
+			case "allow":
+				p.action = actionAllow
+			case "block":
+				p.action = actionBlock
+			case "filter":
+				p.action = actionFilter
+			case "drop":
+				p.action = actionDrop
+			default:
+				return a, c.Errf("unexpected token %q; expect 'allow', 'block', 'filter', 'drop' or 'cache'", c.Val())
+			}
+
+			p.qtypes = make(map[uint16]struct{})
+
+			hasTypeSection := false
+
+			remainingTokens := c.RemainingArgs()
+			for len(remainingTokens) > 0 {
+				if !isPreservedIdentifier(remainingTokens[0]) {
+					return a, c.Errf("unexpected token %q; expect 'type | user | node | tag'", remainingTokens[0])
+				}
+				section := strings.ToLower(remainingTokens[0])
+
+				i := 1
+				var tokens []string
+				for ; i < len(remainingTokens) && !isPreservedIdentifier(remainingTokens[i]); i++ {
+					tokens = append(tokens, remainingTokens[i])
+				}
+				remainingTokens = remainingTokens[i:]
+
+				if len(tokens) == 0 {
+					return a, c.Errf("no token specified in %q section", section)
+				}
+
+				switch section {
+				case "type":
+					hasTypeSection = true
+					for _, token := range tokens {
+						if token == "*" {
+							p.qtypes[dns.TypeNone] = struct{}{}
+							break
+						}
+						qtype, ok := dns.StringToType[token]
+						if !ok {
+							return a, c.Errf("unexpected token %q; expect legal QTYPE", token)
+						}
+						p.qtypes[qtype] = struct{}{}
+					}
+				case "user":
+					p.users = addTokens(p.users, tokens, func(s string) string { return s })
+				case "node":
+					p.nodes = addTokens(p.nodes, tokens, func(s string) string { return strings.ToLower(strings.TrimSuffix(s, ".")) })
+				case "tag":
+					p.tags = addTokens(p.tags, tokens, normalizeTag)
+				}
+			}
+
+			// optional `type` section means all record types.
+			if !hasTypeSection {
+				p.qtypes[dns.TypeNone] = struct{}{}
+			}
+
+			r.policies = append(r.policies, p)
+		}
+		a.Rules = append(a.Rules, r)
+	}
+	return a, nil
+}
+
+func isPreservedIdentifier(token string) bool {
+	identifier := strings.ToLower(token)
+	return identifier == "type" || identifier == "user" || identifier == "node" || identifier == "tag"
+}
+
+// addTokens adds the normalized tokens to set, allocating it when needed.
+func addTokens(set map[string]struct{}, tokens []string, normalize func(string) string) map[string]struct{} {
+	if set == nil {
+		set = make(map[string]struct{}, len(tokens))
+	}
+	for _, token := range tokens {
+		set[normalize(token)] = struct{}{}
+	}
+	return set
+}
+
+// normalizeTag prepends the "tag:" prefix Tailscale uses for ACL tags.
+func normalizeTag(tag string) string {
+	if strings.HasPrefix(tag, "tag:") {
+		return tag
+	}
+	return "tag:" + tag
+}
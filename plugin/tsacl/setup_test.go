@@ -0,0 +1,61 @@
+package tsacl
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"tag", "tsacl {\n allow tag tag:servers\n block\n}", false},
+		{"tag without prefix", "tsacl {\n allow tag servers\n}", false},
+		{"user and type", "tsacl example.org {\n filter user alice@example.org type A AAAA\n}", false},
+		{"node", "tsacl {\n drop node laptop laptop.tail1234.ts.net\n}", false},
+		{"cache", "tsacl {\n cache 30s\n allow\n}", false},
+		{"empty block", "tsacl", false},
+		// Error cases.
+		{"unknown action", "tsacl {\n refuse tag servers\n}", true},
+		{"unknown section", "tsacl {\n block net 10.0.0.0/8\n}", true},
+		{"empty section", "tsacl {\n block tag\n}", true},
+		{"illegal qtype", "tsacl {\n block type ABC\n}", true},
+		{"cache without duration", "tsacl {\n cache\n}", true},
+		{"cache bad duration", "tsacl {\n cache soon\n}", true},
+		{"cache negative duration", "tsacl {\n cache -1s\n}", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctr := caddy.NewTestController("dns", tt.config)
+			if err := setup(ctr); (err != nil) != tt.wantErr {
+				t.Errorf("setup() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	ctr := caddy.NewTestController("dns", "tsacl {\n cache 30s\n allow tag servers node Laptop.\n}")
+	a, err := parse(ctr)
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if a.whois.ttl != 30*time.Second {
+		t.Errorf("cache ttl = %s, want 30s", a.whois.ttl)
+	}
+	if len(a.Rules) != 1 || len(a.Rules[0].policies) != 1 {
+		t.Fatalf("rules = %+v, want one rule with one policy", a.Rules)
+	}
+	p := a.Rules[0].policies[0]
+	if _, ok := p.tags["tag:servers"]; !ok {
+		t.Errorf("tags = %v, want tag:servers", p.tags)
+	}
+	if _, ok := p.nodes["laptop"]; !ok {
+		t.Errorf("nodes = %v, want laptop", p.nodes)
+	}
+}
@@ -0,0 +1,211 @@
+package tsacl
+
+import (
+	"context"
+	"net/netip"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// TSACL enforces access control policies on DNS queries based on the
+// Tailscale identity of the client.
+type TSACL struct {
+	Next plugin.Handler
+
+	Rules []rule
+
+	whois *whoisCache
+}
+
+// rule defines a list of Zones and some ACL policies which will be
+// enforced on them.
+type rule struct {
+	zones    []string
+	policies []policy
+}
+
+// action defines the action against queries.
+type action int
+
+// policy defines the ACL policy for DNS queries.
+// A policy performs the specified action on all DNS queries matched by
+// QTYPE and by the Tailscale user, node or tags of the client. Each
+// non-empty set must match, any element of a set is enough to match it.
+type policy struct {
+	action action
+	qtypes map[uint16]struct{}
+	users  map[string]struct{}
+	nodes  map[string]struct{}
+	tags   map[string]struct{}
+}
+
+const (
+	// actionNone does nothing on the queries.
+	actionNone = iota
+	// actionAllow allows authorized queries to recurse.
+	actionAllow
+	// actionBlock blocks unauthorized queries towards protected DNS zones.
+	actionBlock
+	// actionFilter returns empty sets for queries towards protected DNS zones.
+	actionFilter
+	// actionDrop does not respond for queries towards the protected DNS zones.
+	actionDrop
+)
+
+var log = clog.NewWithPlugin("tsacl")
+
+// ServeDNS implements the plugin.Handler interface.
+func (a *TSACL) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+
+	// The identity is looked up lazily, only once a rule for the zone is found.
+	var id *identity
+	resolved := false
+
+RulesCheckLoop:
+	for _, rule := range a.Rules {
+		// check zone.
+		zone := plugin.Zones(rule.zones).Matches(state.Name())
+		if zone == "" {
+			continue
+		}
+
+		if !resolved && rule.needsIdentity() {
+			var err error
+			if id, err = a.identify(ctx, state); err != nil {
+				// Without the identity the policies can't be applied.
+				return dns.RcodeServerFailure, plugin.Error(a.Name(), err)
+			}
+			resolved = true
+		}
+
+		action := matchWithPolicies(rule.policies, id, state.QType())
+		switch action {
+		case actionDrop:
+			{
+				RequestDropCount.WithLabelValues(metrics.WithServer(ctx), zone, metrics.WithView(ctx)).Inc()
+				return dns.RcodeSuccess, nil
+			}
+		case actionBlock:
+			{
+				m := new(dns.Msg).
+					SetRcode(r, dns.RcodeRefused).
+					SetEdns0(4096, true)
+				ede := dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked}
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &ede)
+				w.WriteMsg(m)
+				RequestBlockCount.WithLabelValues(metrics.WithServer(ctx), zone, metrics.WithView(ctx)).Inc()
+				return dns.RcodeSuccess, nil
+			}
+		case actionAllow:
+			{
+				break RulesCheckLoop
+			}
+		case actionFilter:
+			{
+				m := new(dns.Msg).
+					SetRcode(r, dns.RcodeSuccess).
+					SetEdns0(4096, true)
+				ede := dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeFiltered}
+				m.IsEdns0().Option = append(m.IsEdns0().Option, &ede)
+				w.WriteMsg(m)
+				RequestFilterCount.WithLabelValues(metrics.WithServer(ctx), zone, metrics.WithView(ctx)).Inc()
+				return dns.RcodeSuccess, nil
+			}
+		}
+	}
+
+	RequestAllowCount.WithLabelValues(metrics.WithServer(ctx), metrics.WithView(ctx)).Inc()
+	return plugin.NextOrFailure(state.Name(), a.Next, ctx, w, r)
+}
+
+// identify returns the Tailscale identity of the client, or nil if the source
+// address is not a tailnet peer.
+func (a *TSACL) identify(ctx context.Context, state request.Request) (*identity, error) {
+	addr, err := netip.ParseAddr(state.IP())
+	if err != nil {
+		log.Errorf("Unable to parse source address: %v", state.IP())
+		return nil, nil
+	}
+	return a.whois.lookup(ctx, addr.WithZone("").Unmap())
+}
+
+// needsIdentity reports whether any policy of the rule matches on the
+// Tailscale identity of the client.
+func (r rule) needsIdentity() bool {
+	for _, p := range r.policies {
+		if len(p.users) > 0 || len(p.nodes) > 0 || len(p.tags) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWithPolicies matches the DNS query with a list of ACL polices and returns suitable
+// action against the query.
+func matchWithPolicies(policies []policy, id *identity, qtype uint16) action {
+	for _, policy := range policies {
+		// dns.TypeNone matches all query types.
+		_, matchAll := policy.qtypes[dns.TypeNone]
+		_, match := policy.qtypes[qtype]
+		if !matchAll && !match {
+			continue
+		}
+
+		if !policy.matchIdentity(id) {
+			continue
+		}
+
+		// matched.
+		return policy.action
+	}
+	return actionNone
+}
+
+// matchIdentity reports whether the client identity satisfies the user, node
+// and tag sets of the policy. Clients without identity only match policies
+// that don't restrict any of them.
+func (p policy) matchIdentity(id *identity) bool {
+	if len(p.users) == 0 && len(p.nodes) == 0 && len(p.tags) == 0 {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+
+	if len(p.users) > 0 {
+		if _, ok := p.users[id.user]; !ok {
+			return false
+		}
+	}
+	if len(p.nodes) > 0 {
+		_, short := p.nodes[id.node]
+		_, fqdn := p.nodes[id.fqdn]
+		if !short && !fqdn {
+			return false
+		}
+	}
+	if len(p.tags) > 0 {
+		found := false
+		for _, tag := range id.tags {
+			if _, ok := p.tags[tag]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Name implements the plugin.Handler interface.
+func (a *TSACL) Name() string {
+	return "tsacl"
+}
@@ -0,0 +1,371 @@
+package tsacl
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+type testResponseWriter struct {
+	test.ResponseWriter
+	Rcode int
+	Msg   *dns.Msg
+}
+
+// WriteMsg implement dns.ResponseWriter interface.
+func (t *testResponseWriter) WriteMsg(m *dns.Msg) error {
+	t.Rcode = m.Rcode
+	t.Msg = m
+	return nil
+}
+
+// fakeWhoIs answers WhoIs from a static table and counts the lookups.
+type fakeWhoIs struct {
+	peers map[string]*apitype.WhoIsResponse
+	err   error
+	calls int
+}
+
+func (f *fakeWhoIs) WhoIs(_ context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	resp, ok := f.peers[remoteAddr]
+	if !ok {
+		return nil, local.ErrPeerNotFound
+	}
+	return resp, nil
+}
+
+func newFakeWhoIs() *fakeWhoIs {
+	return &fakeWhoIs{peers: map[string]*apitype.WhoIsResponse{
+		"100.64.0.1": {
+			Node:        &tailcfg.Node{Name: "server.tail1234.ts.net.", Tags: []string{"tag:servers"}},
+			UserProfile: &tailcfg.UserProfile{LoginName: "tagged-devices"},
+		},
+		"100.64.0.2": {
+			Node:        &tailcfg.Node{Name: "laptop.tail1234.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.org"},
+		},
+		"fd7a:115c:a1e0::2": {
+			Node:        &tailcfg.Node{Name: "laptop.tail1234.ts.net."},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.org"},
+		},
+	}}
+}
+
+func TestTSACLServeDNS(t *testing.T) {
+	tests := []struct {
+		name                  string
+		config                string
+		sourceIP              string
+		domain                string
+		qtype                 uint16
+		wantRcode             int
+		wantExtendedErrorCode uint16
+		expectNoResponse      bool
+	}{
+		{
+			name: "tagged server allowed",
+			config: `tsacl internal.example.org {
+				allow tag servers
+				block
+			}`,
+			sourceIP:  "100.64.0.1",
+			domain:    "db.internal.example.org.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name: "untagged laptop blocked",
+			config: `tsacl internal.example.org {
+				allow tag servers
+				block
+			}`,
+			sourceIP:              "100.64.0.2",
+			domain:                "db.internal.example.org.",
+			qtype:                 dns.TypeA,
+			wantRcode:             dns.RcodeRefused,
+			wantExtendedErrorCode: dns.ExtendedErrorCodeBlocked,
+		},
+		{
+			name: "non-tailnet client blocked",
+			config: `tsacl internal.example.org {
+				allow tag servers
+				block
+			}`,
+			sourceIP:              "192.0.2.1",
+			domain:                "db.internal.example.org.",
+			qtype:                 dns.TypeA,
+			wantRcode:             dns.RcodeRefused,
+			wantExtendedErrorCode: dns.ExtendedErrorCodeBlocked,
+		},
+		{
+			name: "other zone untouched",
+			config: `tsacl internal.example.org {
+				block
+			}`,
+			sourceIP:  "100.64.0.2",
+			domain:    "www.example.org.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name: "user filtered",
+			config: `tsacl {
+				filter user alice@example.org type AAAA
+			}`,
+			sourceIP:              "fd7a:115c:a1e0::2",
+			domain:                "www.example.org.",
+			qtype:                 dns.TypeAAAA,
+			wantRcode:             dns.RcodeSuccess,
+			wantExtendedErrorCode: dns.ExtendedErrorCodeFiltered,
+		},
+		{
+			name: "node by short name dropped",
+			config: `tsacl {
+				drop node laptop
+			}`,
+			sourceIP:         "100.64.0.2",
+			domain:           "www.example.org.",
+			qtype:            dns.TypeA,
+			expectNoResponse: true,
+		},
+		{
+			name: "node by fqdn blocked",
+			config: `tsacl {
+				block node laptop.tail1234.ts.net.
+			}`,
+			sourceIP:              "100.64.0.2",
+			domain:                "www.example.org.",
+			qtype:                 dns.TypeA,
+			wantRcode:             dns.RcodeRefused,
+			wantExtendedErrorCode: dns.ExtendedErrorCodeBlocked,
+		},
+		{
+			name: "all sections must match",
+			config: `tsacl {
+				block user alice@example.org tag servers
+			}`,
+			sourceIP:  "100.64.0.2",
+			domain:    "www.example.org.",
+			qtype:     dns.TypeA,
+			wantRcode: dns.RcodeSuccess,
+		},
+	}
+
+	ctx := context.Background()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctr := caddy.NewTestController("dns", tt.config)
+			ctr.ServerBlockKeys = []string{"."}
+			a, err := parse(ctr)
+			if err != nil {
+				t.Fatalf("Cannot parse tsacl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+			a.whois.client = newFakeWhoIs()
+
+			w := &testResponseWriter{}
+			w.RemoteIP = tt.sourceIP
+			m := new(dns.Msg)
+			m.SetQuestion(tt.domain, tt.qtype)
+			if _, err := a.ServeDNS(ctx, w, m); err != nil {
+				t.Fatalf("ServeDNS() error = %v", err)
+			}
+			if tt.expectNoResponse {
+				if w.Msg != nil {
+					t.Errorf("ServeDNS() responded to client when not expected")
+				}
+				return
+			}
+			if w.Rcode != tt.wantRcode {
+				t.Errorf("ServeDNS() Rcode = %v, want %v", w.Rcode, tt.wantRcode)
+			}
+			if tt.wantExtendedErrorCode != 0 {
+				matched := false
+				for _, opt := range w.Msg.IsEdns0().Option {
+					if ede, ok := opt.(*dns.EDNS0_EDE); ok {
+						if ede.InfoCode != tt.wantExtendedErrorCode {
+							t.Errorf("ServeDNS() Extended DNS Error = %v, want %v", ede.InfoCode, tt.wantExtendedErrorCode)
+						}
+						matched = true
+					}
+				}
+				if !matched {
+					t.Error("ServeDNS() missing Extended DNS Error option")
+				}
+			}
+		})
+	}
+}
+
+func TestWhoisCache(t *testing.T) {
+	fake := newFakeWhoIs()
+	now := time.Unix(0, 0)
+	c := newWhoisCache(time.Minute)
+	c.client = fake
+	c.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	server := netip.MustParseAddr("100.64.0.1")
+	outsider := netip.MustParseAddr("192.0.2.1")
+
+	if id, err := c.lookup(ctx, server); err != nil || id == nil || id.node != "server" || id.user != "tagged-devices" {
+		t.Fatalf("lookup(%s) = %+v, %v, want server identity", server, id, err)
+	}
+	if id, err := c.lookup(ctx, outsider); err != nil || id != nil {
+		t.Fatalf("lookup(%s) = %+v, %v, want nil", outsider, id, err)
+	}
+
+	// Both positive and negative answers are cached.
+	c.lookup(ctx, server)
+	c.lookup(ctx, outsider)
+	if fake.calls != 2 {
+		t.Errorf("WhoIs calls = %d, want 2", fake.calls)
+	}
+
+	// Entries expire after the TTL.
+	now = now.Add(2 * time.Minute)
+	c.lookup(ctx, server)
+	if fake.calls != 3 {
+		t.Errorf("WhoIs calls after expiry = %d, want 3", fake.calls)
+	}
+
+	// A netmap change flushes everything.
+	c.flush()
+	c.lookup(ctx, server)
+	if fake.calls != 4 {
+		t.Errorf("WhoIs calls after flush = %d, want 4", fake.calls)
+	}
+
+	// Transient failures are not cached.
+	fake.err = errors.New("tailscaled unavailable")
+	c.flush()
+	if _, err := c.lookup(ctx, server); err == nil {
+		t.Error("lookup with failing WhoIs: expected an error")
+	}
+	fake.err = nil
+	if id, _ := c.lookup(ctx, server); id == nil {
+		t.Errorf("lookup after recovery = nil, want server identity")
+	}
+}
+
+// flushingWhoIs flushes the cache while a lookup is in flight.
+type flushingWhoIs struct {
+	*fakeWhoIs
+	cache *whoisCache
+}
+
+func (f flushingWhoIs) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	f.cache.flush()
+	return f.fakeWhoIs.WhoIs(ctx, remoteAddr)
+}
+
+func TestWhoisCacheFlushDuringLookup(t *testing.T) {
+	c := newWhoisCache(time.Minute)
+	c.client = flushingWhoIs{fakeWhoIs: newFakeWhoIs(), cache: c}
+
+	server := netip.MustParseAddr("100.64.0.1")
+	if id, err := c.lookup(context.Background(), server); err != nil || id == nil {
+		t.Fatalf("lookup(%s) = %+v, %v, want server identity", server, id, err)
+	}
+	if _, ok := c.entries[server]; ok {
+		t.Error("expected a result looked up before a flush not to be cached")
+	}
+}
+
+func TestTSACLWhoIsFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		wantRcode int
+		wantErr   bool
+	}{
+		{
+			name: "identity policy fails closed",
+			config: `tsacl {
+				block tag servers
+			}`,
+			wantRcode: dns.RcodeServerFailure,
+			wantErr:   true,
+		},
+		{
+			name: "no identity needed",
+			config: `tsacl {
+				block type AAAA
+			}`,
+			wantRcode: dns.RcodeSuccess,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctr := caddy.NewTestController("dns", tt.config)
+			ctr.ServerBlockKeys = []string{"."}
+			a, err := parse(ctr)
+			if err != nil {
+				t.Fatalf("Cannot parse tsacl from config: %v", err)
+			}
+			a.Next = test.NextHandler(dns.RcodeSuccess, nil)
+			fake := newFakeWhoIs()
+			fake.err = errors.New("tailscaled unavailable")
+			a.whois.client = fake
+
+			w := &testResponseWriter{}
+			w.RemoteIP = "100.64.0.1"
+			m := new(dns.Msg)
+			m.SetQuestion("www.example.org.", dns.TypeA)
+			rcode, err := a.ServeDNS(context.Background(), w, m)
+			if rcode != tt.wantRcode {
+				t.Errorf("ServeDNS() rcode = %v, want %v", rcode, tt.wantRcode)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ServeDNS() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWhoisCacheBounds(t *testing.T) {
+	fake := newFakeWhoIs()
+	now := time.Unix(0, 0)
+	c := newWhoisCache(time.Minute)
+	c.client = fake
+	c.now = func() time.Time { return now }
+	c.max = 2
+
+	ctx := context.Background()
+	for _, a := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		c.lookup(ctx, netip.MustParseAddr(a))
+	}
+	if n := len(c.entries); n != 2 {
+		t.Errorf("cached %d entries, want at most 2", n)
+	}
+
+	// Expired entries make room first.
+	now = now.Add(2 * time.Minute)
+	c.lookup(ctx, netip.MustParseAddr("192.0.2.4"))
+	if _, ok := c.entries[netip.MustParseAddr("192.0.2.4")]; !ok || len(c.entries) != 1 {
+		t.Errorf("entries = %v, want only 192.0.2.4", c.entries)
+	}
+
+	// Without a TTL nothing is stored.
+	c = newWhoisCache(0)
+	c.client = fake
+	c.lookup(ctx, netip.MustParseAddr("100.64.0.1"))
+	if n := len(c.entries); n != 0 {
+		t.Errorf("cached %d entries with cache 0, want none", n)
+	}
+}
@@ -0,0 +1,146 @@
+package tsacl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// defaultCacheTTL is how long a WhoIs result is reused for a source address.
+const defaultCacheTTL = 1 * time.Minute
+
+// maxCacheEntries bounds the cache, queries from the internet could fill it
+// with addresses that are no tailnet peers.
+const maxCacheEntries = 4096
+
+// whoIser looks up the owner of a tailnet address. The LocalClient of the
+// global tailscale instance implements it.
+type whoIser interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+// identity is the part of a WhoIs response the policies match on.
+type identity struct {
+	user string   // login name of the owner, "tagged-devices" for tagged nodes
+	node string   // short node name, lower case
+	fqdn string   // MagicDNS name without the trailing dot, lower case
+	tags []string // ACL tags, including the "tag:" prefix
+}
+
+func identityFromWhoIs(resp *apitype.WhoIsResponse) *identity {
+	id := &identity{}
+	if resp.UserProfile != nil {
+		id.user = resp.UserProfile.LoginName
+	}
+	if resp.Node != nil {
+		id.fqdn = strings.ToLower(strings.TrimSuffix(resp.Node.Name, "."))
+		id.node, _, _ = strings.Cut(id.fqdn, ".")
+		if id.node == "" {
+			id.node = strings.ToLower(resp.Node.ComputedName)
+		}
+		id.tags = resp.Node.Tags
+	}
+	return id
+}
+
+type cacheEntry struct {
+	id      *identity
+	expires time.Time
+}
+
+// whoisCache caches WhoIs results per source address. Entries expire after
+// ttl and the whole cache is flushed whenever the netmap changes. It holds at
+// most max entries, a zero ttl disables it.
+type whoisCache struct {
+	client whoIser
+	ttl    time.Duration
+	max    int
+	now    func() time.Time
+
+	mu      sync.Mutex
+	entries map[netip.Addr]cacheEntry
+	// gen counts the flushes, results looked up before one are not stored.
+	gen uint64
+}
+
+func newWhoisCache(ttl time.Duration) *whoisCache {
+	return &whoisCache{
+		ttl:     ttl,
+		max:     maxCacheEntries,
+		now:     time.Now,
+		entries: map[netip.Addr]cacheEntry{},
+	}
+}
+
+// lookup returns the identity of addr, or nil if it's not a tailnet peer. An
+// error means tailscaled couldn't tell, it is not cached.
+func (c *whoisCache) lookup(ctx context.Context, addr netip.Addr) (*identity, error) {
+	now := c.now()
+
+	c.mu.Lock()
+	e, ok := c.entries[addr]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		cacheHits.Inc()
+		return e.id, nil
+	}
+	cacheMisses.Inc()
+
+	resp, err := c.client.WhoIs(ctx, addr.String())
+	var id *identity
+	switch {
+	case err == nil:
+		id = identityFromWhoIs(resp)
+	case errors.Is(err, local.ErrPeerNotFound):
+		// Not a tailnet peer, remember that as well.
+	default:
+		return nil, fmt.Errorf("WhoIs lookup of %s: %w", addr, err)
+	}
+
+	if c.ttl > 0 {
+		c.store(addr, cacheEntry{id: id, expires: now.Add(c.ttl)}, now, gen)
+	}
+	return id, nil
+}
+
+// store adds an entry looked up in flush generation gen, unless the cache
+// was flushed since. A full cache first drops the expired entries, then an
+// arbitrary one if that isn't enough.
+func (c *whoisCache) store(addr netip.Addr, e cacheEntry, now time.Time, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen {
+		return
+	}
+
+	if _, ok := c.entries[addr]; !ok && len(c.entries) >= c.max {
+		for a, old := range c.entries {
+			if !now.Before(old.expires) {
+				delete(c.entries, a)
+			}
+		}
+		for a := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, a)
+		}
+	}
+	c.entries[addr] = e
+}
+
+// flush drops all cached entries.
+func (c *whoisCache) flush() {
+	c.mu.Lock()
+	c.entries = map[netip.Addr]cacheEntry{}
+	c.gen++
+	c.mu.Unlock()
+}
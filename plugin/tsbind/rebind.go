@@ -0,0 +1,181 @@
+package tsbind
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/transport"
+)
+
+// binding is a server block using tsbind.
+type binding struct {
+	b       *tsbind
+	configs []*dnsserver.Config
+}
+
+// listener is a server started by the rebinder, with what it listens on.
+type listener struct {
+	server caddy.Server
+	ln     net.Listener
+	pc     net.PacketConn
+}
+
+// rebinder makes the server blocks of an instance follow the node's Tailscale
+// addresses. Servers can't change their address, so it runs servers of its own
+// on addresses the node gets after startup and stops them once the addresses
+// are gone. The servers caddy started stay, an address they listen on that
+// goes away just doesn't receive anything anymore.
+type rebinder struct {
+	mu       sync.Mutex
+	bindings []*binding
+	// initial are the addresses caddy listens on.
+	initial map[string]bool
+	// running are the addresses added since startup.
+	running map[string]*listener
+	cancel  context.CancelFunc
+}
+
+func newRebinder() *rebinder {
+	return &rebinder{initial: map[string]bool{}, running: map[string]*listener{}}
+}
+
+// add registers a server block that listens on the tailnet addresses ips.
+func (r *rebinder) add(bd *binding, ips []netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bindings = append(r.bindings, bd)
+	for addr := range addresses([]*binding{bd}, ips) {
+		r.initial[addr] = true
+	}
+}
+
+// addresses returns the listen addresses of the bindings for a node with the
+// given tailnet addresses, with the configs served on each. Server blocks on
+// the same address share its servers, like at startup.
+func addresses(bindings []*binding, ips []netip.Addr) map[string][]*dnsserver.Config {
+	groups := map[string][]*dnsserver.Config{}
+	for _, bd := range bindings {
+		for _, host := range bd.b.tailnetHosts(ips) {
+			for _, cfg := range bd.configs {
+				addr := cfg.Transport + "://" + net.JoinHostPort(host, cfg.Port)
+				groups[addr] = append(groups[addr], cfg)
+			}
+		}
+	}
+	return groups
+}
+
+// update listens on the addresses the node got and stops listening on the
+// ones it lost. Addresses that can't be listened on yet, e.g. because the
+// interface isn't configured, are tried again with the next update.
+func (r *rebinder) update(ips []netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running == nil {
+		// stopped
+		return
+	}
+
+	want := addresses(r.bindings, ips)
+	for addr, group := range want {
+		if r.initial[addr] || r.running[addr] != nil {
+			continue
+		}
+		l, err := listen(addr, group)
+		if err != nil {
+			log.Warningf("Unable to listen on %s: %v", addr, err)
+			continue
+		}
+		log.Infof("Tailscale address added, listening on %s", addr)
+		r.running[addr] = l
+	}
+	for addr, l := range r.running {
+		if _, ok := want[addr]; ok {
+			continue
+		}
+		log.Infof("Tailscale address removed, stopped listening on %s", addr)
+		l.stop()
+		delete(r.running, addr)
+	}
+}
+
+// stop ends following the addresses and stops the servers started for them.
+func (r *rebinder) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	for _, l := range r.running {
+		l.stop()
+	}
+	r.running = nil
+}
+
+// listen starts a server for group on addr.
+func listen(addr string, group []*dnsserver.Config) (*listener, error) {
+	s, err := newServer(addr, group)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &listener{server: s}
+	if l.ln, err = s.Listen(); err == nil {
+		l.pc, err = s.ListenPacket()
+	}
+	if err != nil {
+		l.stop()
+		return nil, err
+	}
+	if l.ln != nil {
+		go s.Serve(l.ln)
+	}
+	if l.pc != nil {
+		go s.ServePacket(l.pc)
+	}
+	return l, nil
+}
+
+// newServer creates a server for group on addr like caddy does at startup.
+// It builds the plugin chains of its own copies of the configs, the servers
+// caddy started keep theirs.
+func newServer(addr string, group []*dnsserver.Config) (caddy.Server, error) {
+	copies := make([]*dnsserver.Config, len(group))
+	for i, cfg := range group {
+		c := *cfg
+		copies[i] = &c
+	}
+
+	// Configs are only grouped on an address of the same transport.
+	switch group[0].Transport {
+	case transport.TLS:
+		return dnsserver.NewServerTLS(addr, copies)
+	case transport.QUIC:
+		return dnsserver.NewServerQUIC(addr, copies)
+	case transport.GRPC:
+		return dnsserver.NewServergRPC(addr, copies)
+	case transport.HTTPS:
+		return dnsserver.NewServerHTTPS(addr, copies)
+	case transport.HTTPS3:
+		return dnsserver.NewServerHTTPS3(addr, copies)
+	default:
+		return dnsserver.NewServer(addr, copies)
+	}
+}
+
+func (l *listener) stop() {
+	if s, ok := l.server.(caddy.Stopper); ok {
+		s.Stop()
+	}
+	// The server may not have picked them up yet.
+	if l.ln != nil {
+		l.ln.Close()
+	}
+	if l.pc != nil {
+		l.pc.Close()
+	}
+}
@@ -0,0 +1,67 @@
+package tsbind
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestRebinderUpdate(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	}
+	port := strconv.Itoa(pc.LocalAddr().(*net.UDPAddr).Port)
+	pc.Close()
+
+	cfg := &dnsserver.Config{Zone: ".", Transport: "dns", Port: port, ListenHosts: []string{"127.0.0.1"}}
+	cfg.AddPlugin(func(plugin.Handler) plugin.Handler { return test.ErrorHandler() })
+	// Compile the plugin chain like caddy does at startup.
+	if _, err := dnsserver.NewServer("dns://127.0.0.1:"+port, []*dnsserver.Config{cfg}); err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("127.0.0.2")
+	r := newRebinder()
+	r.add(&binding{b: &tsbind{family: familyIPv4}, configs: []*dnsserver.Config{cfg}}, []netip.Addr{first})
+	t.Cleanup(r.stop)
+
+	addr := net.JoinHostPort("127.0.0.2", port)
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+
+	r.update([]netip.Addr{first, second})
+	if len(r.running) != 1 {
+		t.Fatalf("expected a server for the added address, got %v", r.running)
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		resp, _, err := (&dns.Client{Net: network}).Exchange(m, addr)
+		if err != nil {
+			t.Fatalf("%s query to the added address: %v", network, err)
+		}
+		if resp.Rcode != dns.RcodeServerFailure {
+			t.Errorf("%s query: expected the chain's SERVFAIL, got %s", network, dns.RcodeToString[resp.Rcode])
+		}
+	}
+
+	// The address caddy listens on is left to it.
+	r.update([]netip.Addr{second})
+	if len(r.running) != 1 {
+		t.Errorf("expected the startup address not to be served by the rebinder, got %v", r.running)
+	}
+
+	r.update([]netip.Addr{first})
+	if len(r.running) != 0 {
+		t.Fatalf("expected the server of the removed address to stop, got %v", r.running)
+	}
+	if _, _, err := (&dns.Client{Net: "tcp"}).Exchange(m, addr); err == nil {
+		t.Error("expected the removed address not to answer")
+	}
+}
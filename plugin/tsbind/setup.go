@@ -0,0 +1,139 @@
+package tsbind
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/tailscale"
+
+	"tailscale.com/types/netmap"
+)
+
+const pluginName = "tsbind"
+
+var log = clog.NewWithPlugin(pluginName)
+
+func init() { plugin.Register(pluginName, setup) }
+
+// rebinderKey stores the rebinder of an instance in its storage.
+type rebinderKey struct{}
+
+func setup(c *caddy.Controller) error {
+	b, err := parse(c)
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+
+	ts := tailscale.GetGlobalTailscale()
+	if ts == nil {
+		return plugin.Error(pluginName, fmt.Errorf("tailscale plugin not initialized"))
+	}
+
+	config := dnsserver.GetConfig(c)
+
+	// The embedded node's addresses live in a userspace network stack, the
+	// host can't bind them.
+	if ts.Embedded() {
+		if b.family != familyNone {
+			if len(b.extra) == 0 {
+				return plugin.Error(pluginName, fmt.Errorf("embedded tailscale running, tailnet addresses can't be listened on; use 'tsbind none' or give addresses"))
+			}
+			log.Warning("embedded tailscale running, tailnet addresses can't be listened on")
+		}
+		config.ListenHosts = b.extra
+		return nil
+	}
+
+	status, err := ts.Client.StatusWithoutPeers(context.Background())
+	if err != nil {
+		return plugin.Error(pluginName, err)
+	}
+	// Without a running backend there may be no addresses yet, they are
+	// picked up by the rebinder.
+	config.ListenHosts = b.hosts(status.TailscaleIPs)
+	log.Infof("DNS configured to listen on %v", config.ListenHosts)
+
+	if b.family == familyNone {
+		return nil
+	}
+
+	// One rebinder follows the addresses for all server blocks of the instance.
+	r, ok := c.Get(rebinderKey{}).(*rebinder)
+	if !ok {
+		r = newRebinder()
+		c.Set(rebinderKey{}, r)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		r.cancel = cancel
+		tailscale.OnStarted(c, func() {
+			go ts.WatchNetMap(ctx, func(nm *netmap.NetworkMap) {
+				ips := make([]netip.Addr, 0, nm.GetAddresses().Len())
+				for _, p := range nm.GetAddresses().All() {
+					ips = append(ips, p.Addr())
+				}
+				r.update(ips)
+			}, nil)
+		})
+		c.OnShutdown(func() error {
+			r.stop()
+			return nil
+		})
+	}
+	r.add(&binding{b: b, configs: blockConfigs(c)}, status.TailscaleIPs)
+
+	return nil
+}
+
+// blockConfigs returns the configs of all zones of the server block c sets
+// up. They share the plugins of the first one.
+func blockConfigs(c *caddy.Controller) []*dnsserver.Config {
+	keyIndex := c.ServerBlockKeyIndex
+	defer func() { c.ServerBlockKeyIndex = keyIndex }()
+
+	configs := make([]*dnsserver.Config, 0, len(c.ServerBlockKeys))
+	for i := range c.ServerBlockKeys {
+		c.ServerBlockKeyIndex = i
+		configs = append(configs, dnsserver.GetConfig(c))
+	}
+	return configs
+}
+
+// parse reads the tsbind directive:
+//
+//	tsbind [all|ipv4|ipv6|none] [ADDRESS...]
+func parse(c *caddy.Controller) (*tsbind, error) {
+	b := &tsbind{family: familyAll}
+	i := 0
+	for c.Next() {
+		if i > 0 {
+			return nil, plugin.ErrOnce
+		}
+		i++
+
+		args := c.RemainingArgs()
+		if len(args) > 0 {
+			switch args[0] {
+			case familyAll, familyIPv4, familyIPv6, familyNone:
+				b.family = args[0]
+				args = args[1:]
+			}
+		}
+		for _, arg := range args {
+			addr, err := netip.ParseAddr(arg)
+			if err != nil {
+				return nil, fmt.Errorf("not a valid IP address: %q", arg)
+			}
+			b.extra = append(b.extra, addr.String())
+		}
+
+		if c.NextBlock() {
+			return nil, c.Errf("unknown property '%s'", c.Val())
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,70 @@
+package tsbind
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		want      tsbind
+	}{
+		{input: "tsbind", want: tsbind{family: familyAll}},
+		{input: "tsbind ipv4", want: tsbind{family: familyIPv4}},
+		{input: "tsbind ipv6 ::1", want: tsbind{family: familyIPv6, extra: []string{"::1"}}},
+		{input: "tsbind none", want: tsbind{family: familyNone}},
+		{input: "tsbind 127.0.0.1 192.0.2.1", want: tsbind{family: familyAll, extra: []string{"127.0.0.1", "192.0.2.1"}}},
+		// Error cases.
+		{input: "tsbind eth0", shouldErr: true},
+		{input: "tsbind ipv4 ipv6", shouldErr: true},
+		{input: "tsbind {\n except 127.0.0.1\n}", shouldErr: true},
+		{input: "tsbind\ntsbind ipv4", shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		got, err := parse(c)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("test %d: expected error, got %+v", i, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if diff := cmp.Diff(tc.want, *got, cmp.AllowUnexported(tsbind{})); diff != "" {
+			t.Errorf("test %d: mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestSetupWithoutTailscale(t *testing.T) {
+	c := caddy.NewTestController("dns", "tsbind")
+	if err := setup(c); err == nil {
+		t.Error("expected an error without the tailscale plugin")
+	}
+}
+
+func TestBlockConfigs(t *testing.T) {
+	c := caddy.NewTestController("dns", "tsbind")
+	c.ServerBlockKeys = []string{"example.org:53", "example.net:53"}
+
+	configs := blockConfigs(c)
+	if len(configs) != 2 || configs[0] == configs[1] {
+		t.Fatalf("expected a config for each zone, got %v", configs)
+	}
+	if c.ServerBlockKeyIndex != 0 {
+		t.Errorf("expected the key index to be restored, got %d", c.ServerBlockKeyIndex)
+	}
+	if configs[0] != dnsserver.GetConfig(c) {
+		t.Error("expected the first config to be the one of the block")
+	}
+}
@@ -0,0 +1,44 @@
+// Package tsbind makes a server block listen on the Tailscale addresses of the node.
+package tsbind
+
+import (
+	"net/netip"
+	"slices"
+)
+
+// Address families of the tailnet addresses to listen on.
+const (
+	familyAll  = "all"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+	familyNone = "none"
+)
+
+// tsbind selects the listen addresses of a server block.
+type tsbind struct {
+	// family selects which tailnet addresses of the node are used.
+	family string
+	// extra addresses are listened on in addition to the tailnet ones.
+	extra []string
+}
+
+// tailnetHosts returns the tailnet addresses of the node selected by family.
+func (b *tsbind) tailnetHosts(ips []netip.Addr) []string {
+	hosts := []string{}
+	for _, ip := range ips {
+		switch {
+		case b.family == familyNone:
+		case b.family == familyIPv4 && !ip.Is4():
+		case b.family == familyIPv6 && !ip.Is6():
+		default:
+			hosts = append(hosts, ip.String())
+		}
+	}
+	slices.Sort(hosts)
+	return hosts
+}
+
+// hosts returns the listen addresses for a node with the given tailnet addresses.
+func (b *tsbind) hosts(ips []netip.Addr) []string {
+	return append(b.tailnetHosts(ips), b.extra...)
+}
@@ -0,0 +1,34 @@
+package tsbind
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHosts(t *testing.T) {
+	ips := []netip.Addr{
+		netip.MustParseAddr("fd7a:115c:a1e0::1"),
+		netip.MustParseAddr("100.64.0.1"),
+	}
+
+	tests := []struct {
+		b    tsbind
+		want []string
+	}{
+		{tsbind{family: familyAll}, []string{"100.64.0.1", "fd7a:115c:a1e0::1"}},
+		{tsbind{family: familyIPv4}, []string{"100.64.0.1"}},
+		{tsbind{family: familyIPv6}, []string{"fd7a:115c:a1e0::1"}},
+		{tsbind{family: familyIPv4, extra: []string{"127.0.0.1"}}, []string{"100.64.0.1", "127.0.0.1"}},
+		{tsbind{family: familyNone, extra: []string{"127.0.0.1"}}, []string{"127.0.0.1"}},
+		// An empty list keeps the server block from listening at all.
+		{tsbind{family: familyNone}, []string{}},
+	}
+
+	for i, tc := range tests {
+		if diff := cmp.Diff(tc.want, tc.b.hosts(ips)); diff != "" {
+			t.Errorf("test %d: hosts mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package tsmetadata
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/tailscale"
+)
+
+func init() { plugin.Register(pluginName, setup) }
+
+func setup(c *caddy.Controller) error {
+	m := &TSMetadata{}
+	for c.Next() {
+		if c.NextArg() || c.NextBlock() {
+			return plugin.Error(pluginName, c.ArgErr())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.OnStartup(func() error {
+		if tailscale.GetGlobalTailscale() == nil {
+			return fmt.Errorf("tsmetadata: tailscale plugin not initialized")
+		}
+		return nil
+	})
+	tailscale.OnStarted(c, func() {
+		go tailscale.GetGlobalTailscale().WatchNetMap(ctx, m.processNetMap, nil)
+	})
+	c.OnShutdown(func() error {
+		cancel()
+		return nil
+	})
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		m.Next = next
+		return m
+	})
+
+	return nil
+}
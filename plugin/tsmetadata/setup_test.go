@@ -0,0 +1,29 @@
+package tsmetadata
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"tsmetadata", false},
+		{"tsmetadata extra", true},
+		{"tsmetadata {\n option\n}", true},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		err := setup(c)
+		if tc.shouldErr && err == nil {
+			t.Errorf("test %d: expected error, got none", i)
+		}
+		if !tc.shouldErr && err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package tsmetadata
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metadata"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+const pluginName = "tsmetadata"
+
+// labelPrefix namespaces the published labels. They describe the tailnet
+// peer, not this plugin, so they live under "tailscale/".
+const labelPrefix = "tailscale/"
+
+var log = clog.NewWithPlugin(pluginName)
+
+// TSMetadata publishes the Tailscale identity of the client as request metadata.
+type TSMetadata struct {
+	Next plugin.Handler
+
+	mu    sync.RWMutex
+	peers map[netip.Addr]*peer
+}
+
+// peer is the identity of a tailnet node, as published in the metadata.
+type peer struct {
+	user string
+	node string
+	fqdn string
+	tags string
+	os   string
+}
+
+// ServeDNS implements the plugin.Handler interface.
+func (m *TSMetadata) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	return plugin.NextOrFailure(pluginName, m.Next, ctx, w, r)
+}
+
+// Metadata implements the metadata.Provider Interface in the metadata plugin, and is used to store
+// the identity of the tailnet node behind the source IP of every request.
+func (m *TSMetadata) Metadata(ctx context.Context, state request.Request) context.Context {
+	srcIP, err := netip.ParseAddr(state.IP())
+	if err != nil {
+		log.Debugf("Failed to parse source IP %q: %v", state.IP(), err)
+		return ctx
+	}
+
+	m.mu.RLock()
+	p, ok := m.peers[srcIP.WithZone("").Unmap()]
+	m.mu.RUnlock()
+	if !ok {
+		return ctx
+	}
+
+	metadata.SetValueFunc(ctx, labelPrefix+"user", func() string { return p.user })
+	metadata.SetValueFunc(ctx, labelPrefix+"node", func() string { return p.node })
+	metadata.SetValueFunc(ctx, labelPrefix+"fqdn", func() string { return p.fqdn })
+	metadata.SetValueFunc(ctx, labelPrefix+"tags", func() string { return p.tags })
+	metadata.SetValueFunc(ctx, labelPrefix+"os", func() string { return p.os })
+	return ctx
+}
+
+// processNetMap rebuilds the address index from the netmap.
+func (m *TSMetadata) processNetMap(nm *netmap.NetworkMap) {
+	peers := map[netip.Addr]*peer{}
+	nodes := make([]tailcfg.NodeView, 0, 1+len(nm.Peers))
+	nodes = append(nodes, nm.SelfNode)
+	nodes = append(nodes, nm.Peers...)
+	for _, node := range nodes {
+		if !node.Valid() {
+			continue
+		}
+
+		p := &peer{
+			node: node.ComputedName(),
+			fqdn: strings.TrimSuffix(node.Name(), "."),
+			tags: strings.Join(node.Tags().AsSlice(), ","),
+		}
+		if up, ok := nm.UserProfiles[node.User()]; ok {
+			p.user = up.LoginName()
+		}
+		if hi := node.Hostinfo(); hi.Valid() {
+			p.os = hi.OS()
+		}
+
+		for _, pfx := range node.Addresses().All() {
+			if pfx.IsSingleIP() {
+				peers[pfx.Addr()] = p
+			}
+		}
+	}
+
+	m.mu.Lock()
+	m.peers = peers
+	m.mu.Unlock()
+
+	log.Debugf("indexed %d Tailscale addresses", len(peers))
+}
+
+// Name implements the Handler interface.
+func (m *TSMetadata) Name() string { return pluginName }
@@ -0,0 +1,124 @@
+package tsmetadata
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func newNetMap() *netmap.NetworkMap {
+	return &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			Name:         "gateway.tail1234.ts.net.",
+			ComputedName: "gateway",
+			User:         1,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         []string{"tag:gateway"},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				Name:         "server.tail1234.ts.net.",
+				ComputedName: "server",
+				User:         1,
+				Addresses: []netip.Prefix{
+					netip.MustParsePrefix("100.64.0.2/32"),
+					netip.MustParsePrefix("fd7a:115c:a1e0::2/128"),
+				},
+				Tags:     []string{"tag:servers", "tag:db"},
+				Hostinfo: (&tailcfg.Hostinfo{OS: "linux"}).View(),
+			}).View(),
+			(&tailcfg.Node{
+				Name:         "laptop.tail1234.ts.net.",
+				ComputedName: "laptop",
+				User:         2,
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+				Hostinfo:     (&tailcfg.Hostinfo{OS: "macOS"}).View(),
+			}).View(),
+		},
+		UserProfiles: map[tailcfg.UserID]tailcfg.UserProfileView{
+			1: (&tailcfg.UserProfile{ID: 1, LoginName: "tagged-devices"}).View(),
+			2: (&tailcfg.UserProfile{ID: 2, LoginName: "alice@example.org"}).View(),
+		},
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	m := &TSMetadata{}
+	m.processNetMap(newNetMap())
+
+	tests := []struct {
+		remoteIP string
+		label    string
+		want     string
+	}{
+		{"100.64.0.2", "tailscale/user", "tagged-devices"},
+		{"100.64.0.2", "tailscale/node", "server"},
+		{"100.64.0.2", "tailscale/fqdn", "server.tail1234.ts.net"},
+		{"100.64.0.2", "tailscale/tags", "tag:servers,tag:db"},
+		{"100.64.0.2", "tailscale/os", "linux"},
+		{"fd7a:115c:a1e0::2", "tailscale/node", "server"},
+		{"100.64.0.3", "tailscale/user", "alice@example.org"},
+		{"100.64.0.3", "tailscale/tags", ""},
+		{"100.64.0.3", "tailscale/os", "macOS"},
+		{"100.64.0.1", "tailscale/node", "gateway"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.remoteIP+"/"+tc.label, func(t *testing.T) {
+			state := request.Request{
+				Req: new(dns.Msg),
+				W:   &test.ResponseWriter{RemoteIP: tc.remoteIP},
+			}
+			ctx := metadata.ContextWithMetadata(context.Background())
+			m.Metadata(ctx, state)
+
+			fn := metadata.ValueFunc(ctx, tc.label)
+			if fn == nil {
+				t.Fatalf("label %q not set in metadata plugin context", tc.label)
+			}
+			if got := fn(); got != tc.want {
+				t.Errorf("expected value for label %q should be %q, got %q instead", tc.label, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestMetadataUnknownIP(t *testing.T) {
+	m := &TSMetadata{}
+	m.processNetMap(newNetMap())
+
+	state := request.Request{
+		Req: new(dns.Msg),
+		W:   &test.ResponseWriter{RemoteIP: "192.0.2.1"},
+	}
+	ctx := metadata.ContextWithMetadata(context.Background())
+	m.Metadata(ctx, state)
+
+	if labels := metadata.Labels(ctx); len(labels) != 0 {
+		t.Errorf("expected no labels for a non-tailnet client, got %v", labels)
+	}
+}
+
+func TestProcessNetMapReplacesPeers(t *testing.T) {
+	m := &TSMetadata{}
+	m.processNetMap(newNetMap())
+
+	nm := newNetMap()
+	nm.Peers = nil
+	m.processNetMap(nm)
+
+	if _, ok := m.peers[netip.MustParseAddr("100.64.0.2")]; ok {
+		t.Errorf("removed peer is still indexed")
+	}
+	if _, ok := m.peers[netip.MustParseAddr("100.64.0.1")]; !ok {
+		t.Errorf("self node is not indexed")
+	}
+}
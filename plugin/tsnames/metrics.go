@@ -31,6 +31,13 @@ var (
 		Help:      "Number of Tailscale hostname entries currently tracked.",
 	}, []string{"zone"})
 
+	sourceEntriesGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tsnames",
+		Name:      "source_entries",
+		Help:      "Number of Tailscale hostname entries currently tracked, by whether they come from the tailnet, were shared into it or are Tailscale Services.",
+	}, []string{"zone", "source"})
+
 	netmapUpdatesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 		Namespace: plugin.Namespace,
 		Subsystem: "tsnames",
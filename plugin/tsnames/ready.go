@@ -0,0 +1,9 @@
+package tailscale
+
+// Ready implements the ready.Readiness interface. tsnames is ready once it has
+// entries to serve, either from a live netmap or from the snapshot.
+func (t *Tailscale) Ready() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.entries != nil
+}
@@ -0,0 +1,175 @@
+package tailscale
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+)
+
+// routeLabel is the label below which "which node routes this address"
+// queries are answered, e.g. 192-168-1-10._route.<zone>.
+const routeLabel = "_route"
+
+// nodeRoute is a prefix reachable through a node, named relative to the zone.
+type nodeRoute struct {
+	prefix netip.Prefix
+	node   string
+}
+
+// addRoutes records the node's own addresses and the routes it serves, and
+// describes the routes in a TXT record under _routes.<name>. Subnet and exit
+// routes are the node's AllowedIPs besides its own addresses.
+func (t *Tailscale) addRoutes(entries map[string]map[string][]string, routes []nodeRoute, node tailcfg.NodeView, name string) []nodeRoute {
+	var txt []string
+	for _, pfx := range node.AllowedIPs().AsSlice() {
+		routes = append(routes, nodeRoute{prefix: pfx.Masked(), node: name})
+		if !slices.Contains(node.Addresses().AsSlice(), pfx) {
+			txt = append(txt, pfx.Masked().String())
+		}
+	}
+	if len(txt) > 0 {
+		entries["_routes."+name] = map[string][]string{"TXT": txt}
+	}
+	return routes
+}
+
+// routedBy returns the routes with the longest prefix containing addr, sorted
+// by node name. The caller must hold t.mu.
+func (t *Tailscale) routedBy(addr netip.Addr) []nodeRoute {
+	best := -1
+	var via []nodeRoute
+	for _, r := range t.routeTable {
+		if !r.prefix.Contains(addr) || r.prefix.Bits() < best {
+			continue
+		}
+		if r.prefix.Bits() > best {
+			best = r.prefix.Bits()
+			via = via[:0]
+		}
+		via = append(via, r)
+	}
+	slices.SortFunc(via, func(a, b nodeRoute) int { return strings.Compare(a.node, b.node) })
+	return via
+}
+
+// parseRouteLabel parses an address written with dashes instead of dots or
+// colons, e.g. 192-168-1-10 or fd7a-115c-a1e0--1.
+func parseRouteLabel(label string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(strings.ReplaceAll(label, "-", ".")); err == nil && addr.Is4() {
+		return addr, true
+	}
+	if addr, err := netip.ParseAddr(strings.ReplaceAll(label, "-", ":")); err == nil && addr.Is6() {
+		return addr, true
+	}
+	return netip.Addr{}, false
+}
+
+// routeQuery returns the address label of a <address>._route.<zone> name.
+func (t *Tailscale) routeQuery(domainName string) (string, bool) {
+	if !t.routes {
+		return "", false
+	}
+	rel, ok := t.relName(domainName)
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(rel, "."+routeLabel)
+}
+
+// resolveRoute answers <address>._route.<zone> queries. TXT queries list the
+// nodes routing the address together with the matching prefix, address queries
+// get a CNAME to the first of those nodes.
+func (t *Tailscale) resolveRoute(domainName, label string, qtype uint16, msg *dns.Msg) {
+	addr, ok := parseRouteLabel(label)
+	if !ok {
+		return
+	}
+	via := t.routedBy(addr)
+	if len(via) == 0 {
+		return
+	}
+
+	zone, _ := t.zoneOf(domainName)
+	switch qtype {
+	case dns.TypeTXT:
+		for _, r := range via {
+			msg.Answer = append(msg.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.ttl},
+				Txt: []string{"via=" + dnsutil.Join(r.node, dns.Fqdn(zone)), "route=" + r.prefix.String()},
+			})
+		}
+
+	case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+		target := dnsutil.Join(via[0].node, dns.Fqdn(zone))
+		msg.Answer = append(msg.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: domainName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: t.ttl},
+			Target: target,
+		})
+		if qtype == dns.TypeA {
+			t.resolveAAt(target, msg, 1)
+		} else if qtype == dns.TypeAAAA {
+			t.resolveAAAAAt(target, msg, 1)
+		}
+	}
+}
+
+// resolveDelegation refers PTR queries for addresses in advertised subnet
+// routes to the routing nodes. The delegated reverse zone is the route rounded
+// to the next label boundary, i.e. a whole octet or nibble.
+func (t *Tailscale) resolveDelegation(domainName string, msg *dns.Msg) {
+	addr, err := netip.ParseAddr(dnsutil.ExtractAddressFromReverse(strings.ToLower(domainName)))
+	if err != nil || isTailnetAddr(addr) {
+		return
+	}
+
+	via := t.routedBy(addr)
+	if len(via) == 0 || via[0].prefix.Bits() == 0 {
+		// Exit routes cover the whole internet, there is nothing to delegate.
+		return
+	}
+
+	zoneName := reverseZone(addr, via[0].prefix.Bits())
+	for _, r := range via {
+		ns := dnsutil.Join(r.node, dns.Fqdn(t.zone))
+		msg.Ns = append(msg.Ns, &dns.NS{
+			Hdr: dns.RR_Header{Name: zoneName, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: t.ttl},
+			Ns:  ns,
+		})
+
+		glue := dns.Msg{}
+		t.resolveAAt(ns, &glue, 0)
+		t.resolveAAAAAt(ns, &glue, 0)
+		msg.Extra = append(msg.Extra, glue.Answer...)
+	}
+	msg.Authoritative = false
+}
+
+// reverseZone returns the name of the reverse zone holding addr, for a prefix
+// of bits rounded up to whole labels.
+func reverseZone(addr netip.Addr, bits int) string {
+	if addr.Is4() {
+		octets := addr.As4()
+		labels := []string{"in-addr.arpa."}
+		for i := 0; i < (bits+7)/8; i++ {
+			labels = append([]string{fmt.Sprint(octets[i])}, labels...)
+		}
+		return strings.Join(labels, ".")
+	}
+
+	bytes := addr.As16()
+	labels := []string{"ip6.arpa."}
+	for i := 0; i < (bits+3)/4; i++ {
+		nibble := bytes[i/2] >> 4
+		if i%2 == 1 {
+			nibble = bytes[i/2] & 0xf
+		}
+		labels = append([]string{fmt.Sprintf("%x", nibble)}, labels...)
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,162 @@
+package tailscale
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func newRoutesTS() *Tailscale {
+	ts := &Tailscale{zone: "routes.example", routes: true, ttl: defaultTTL, cnameTTL: defaultTTL, negativeTTL: defaultTTL}
+
+	node := func(name string, addrs []string, routes ...string) tailcfg.NodeView {
+		n := &tailcfg.Node{ComputedName: name}
+		for _, a := range addrs {
+			n.Addresses = append(n.Addresses, netip.MustParsePrefix(a))
+		}
+		n.AllowedIPs = append(n.AllowedIPs, n.Addresses...)
+		for _, r := range routes {
+			n.AllowedIPs = append(n.AllowedIPs, netip.MustParsePrefix(r))
+		}
+		return n.View()
+	}
+	ts.processNetMap(&netmap.NetworkMap{
+		SelfNode: node("self", []string{"100.64.0.1/32"}),
+		Peers: []tailcfg.NodeView{
+			node("router", []string{"100.64.0.2/32", "fd7a:115c:a1e0::2/128"}, "192.168.1.0/24", "10.0.0.0/8", "2001:db8::/48"),
+			node("narrow", []string{"100.64.0.3/32"}, "10.1.0.0/22"),
+			node("exit", []string{"100.64.0.4/32"}, "0.0.0.0/0", "::/0"),
+		},
+	})
+	return ts
+}
+
+func TestProcessNetMapRoutes(t *testing.T) {
+	ts := newRoutesTS()
+
+	want := []string{"192.168.1.0/24", "10.0.0.0/8", "2001:db8::/48"}
+	if diff := cmp.Diff(want, ts.entries["_routes.router"]["TXT"]); diff != "" {
+		t.Errorf("router routes mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"0.0.0.0/0", "::/0"}, ts.entries["_routes.exit"]["TXT"]); diff != "" {
+		t.Errorf("exit routes mismatch (-want +got):\n%s", diff)
+	}
+	// Nodes without routes get no record.
+	if _, ok := ts.entries["_routes.self"]; ok {
+		t.Error("unexpected routes for self")
+	}
+}
+
+func TestParseRouteLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"192-168-1-10", "192.168.1.10"},
+		{"fd7a-115c-a1e0--1", "fd7a:115c:a1e0::1"},
+		{"router", ""},
+		{"192-168-1", ""},
+	}
+	for _, tc := range tests {
+		addr, ok := parseRouteLabel(tc.label)
+		if got := addr.String(); ok != (tc.want != "") || (ok && got != tc.want) {
+			t.Errorf("parseRouteLabel(%q) = %s, %v; want %q", tc.label, got, ok, tc.want)
+		}
+	}
+}
+
+func TestReverseZone(t *testing.T) {
+	tests := []struct {
+		addr string
+		bits int
+		want string
+	}{
+		{"192.168.1.10", 24, "1.168.192.in-addr.arpa."},
+		{"10.1.2.3", 8, "10.in-addr.arpa."},
+		// Prefixes are rounded up to whole labels.
+		{"10.1.2.3", 22, "2.1.10.in-addr.arpa."},
+		{"2001:db8::1", 48, "0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{"2001:db8::1", 30, "8.b.d.0.1.0.0.2.ip6.arpa."},
+	}
+	for _, tc := range tests {
+		if got := reverseZone(netip.MustParseAddr(tc.addr), tc.bits); got != tc.want {
+			t.Errorf("reverseZone(%s, %d) = %s, want %s", tc.addr, tc.bits, got, tc.want)
+		}
+	}
+}
+
+func TestServeDNSRouteQuery(t *testing.T) {
+	ts := newRoutesTS()
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string
+	}{
+		// The longest prefix wins.
+		{"10-1-2-3._route.routes.example.", dns.TypeTXT, []string{"via=narrow.routes.example. route=10.1.0.0/22"}},
+		{"10-2-0-1._route.routes.example.", dns.TypeTXT, []string{"via=router.routes.example. route=10.0.0.0/8"}},
+		{"8-8-8-8._route.routes.example.", dns.TypeTXT, []string{"via=exit.routes.example. route=0.0.0.0/0"}},
+		{"100-64-0-1._route.routes.example.", dns.TypeTXT, []string{"via=self.routes.example. route=100.64.0.1/32"}},
+		{"192-168-1-10._route.routes.example.", dns.TypeA, []string{"router.routes.example.", "100.64.0.2"}},
+		{"2001-db8--1._route.routes.example.", dns.TypeAAAA, []string{"router.routes.example.", "fd7a:115c:a1e0::2"}},
+	}
+	for _, tc := range tests {
+		var msg dns.Msg
+		msg.SetQuestion(tc.name, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+
+		var got []string
+		for _, rr := range w.Msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.TXT:
+				got = append(got, rr.Txt[0]+" "+rr.Txt[1])
+			case *dns.CNAME:
+				got = append(got, rr.Target)
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.AAAA:
+				got = append(got, rr.AAAA.String())
+			}
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("%s: answer mismatch (-want +got):\n%s", tc.name, diff)
+		}
+	}
+}
+
+func TestServeDNSDelegation(t *testing.T) {
+	ts := newRoutesTS()
+
+	var msg dns.Msg
+	msg.SetQuestion("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err := ts.ServeDNS(context.Background(), w, &msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "rcode", dns.RcodeSuccess, resp)
+	testEquals(t, "answer count", 0, len(w.Msg.Answer))
+	testEquals(t, "authoritative", false, w.Msg.Authoritative)
+	ns := w.Msg.Ns[0].(*dns.NS)
+	testEquals(t, "zone", "1.168.192.in-addr.arpa.", ns.Hdr.Name)
+	testEquals(t, "NS", "router.routes.example.", ns.Ns)
+	testEquals(t, "glue count", 2, len(w.Msg.Extra))
+
+	// Addresses only reachable through an exit node are not delegated.
+	msg.SetQuestion("8.8.8.8.in-addr.arpa.", dns.TypePTR)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, _ = ts.ServeDNS(context.Background(), w, &msg)
+	testEquals(t, "rcode", dns.RcodeNameError, resp)
+}
@@ -3,10 +3,12 @@ package tailscale
 import (
 	"context"
 	"net"
+	"net/netip"
 	"strings"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 
 	"github.com/miekg/dns"
@@ -28,6 +30,85 @@ const (
 // through itself cannot blow the goroutine stack.
 const maxCNAMEDepth = 8
 
+// answerTTL returns ttl for the records of the entry name, of any type and
+// including PTR records pointing at it, lowered to the changed TTL while the
+// entry's records changed within the changed window.
+func (t *Tailscale) answerTTL(name string, ttl uint32) uint32 {
+	at, ok := t.changed[name]
+	if ok && time.Since(at) < t.changedWindow && t.changedTTL < ttl {
+		return t.changedTTL
+	}
+	return ttl
+}
+
+// servedZones returns the primary zone, the additional zones and, once known,
+// the tailnet's MagicDNS domain.
+func (t *Tailscale) servedZones() []string {
+	zones := make([]string, 0, 2+len(t.zones))
+	zones = append(zones, t.zone)
+	zones = append(zones, t.zones...)
+	if t.magicDNSZone != "" {
+		zones = append(zones, t.magicDNSZone)
+	}
+	return zones
+}
+
+// zoneOf returns the most specific served zone that domainName is in.
+func (t *Tailscale) zoneOf(domainName string) (string, bool) {
+	name := dns.Fqdn(domainName)
+	match := ""
+	for _, zone := range t.servedZones() {
+		if dns.IsSubDomain(dns.Fqdn(zone), name) && len(zone) > len(match) {
+			match = zone
+		}
+	}
+	return match, match != ""
+}
+
+// qualify moves a name of the primary zone, as stored in the entries, into zone.
+func (t *Tailscale) qualify(domainName, zone string) string {
+	if zone == t.zone {
+		return domainName
+	}
+	if rel, ok := strings.CutSuffix(strings.ToLower(dns.Fqdn(domainName)), "."+dns.Fqdn(t.zone)); ok {
+		return dnsutil.Join(rel, dns.Fqdn(zone))
+	}
+	return domainName
+}
+
+// relName returns domainName relative to its zone, lowercased and without the
+// trailing dot. It reports false for the apex and for names outside the zones.
+func (t *Tailscale) relName(domainName string) (string, bool) {
+	zone, ok := t.zoneOf(domainName)
+	if !ok {
+		return "", false
+	}
+	return strings.CutSuffix(strings.ToLower(dns.Fqdn(domainName)), "."+dns.Fqdn(zone))
+}
+
+// lookup returns the key of the entry answering for domainName. In wildcard
+// mode a name below a node, like foo.<node>.<zone>, falls back to the closest
+// node above it, which may have several labels itself (e.g. shared nodes named
+// <node>.<tailnet>). Service entries like _http._tcp are no nodes.
+func (t *Tailscale) lookup(domainName string) (string, bool) {
+	name, ok := t.relName(domainName)
+	if !ok {
+		return "", false
+	}
+	if _, ok := t.entries[name]; ok {
+		return name, true
+	}
+	if t.wildcard {
+		for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+			name = name[i+1:]
+			if _, ok := t.entries[name]; ok && !strings.HasPrefix(name, "_") {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
 func (t *Tailscale) resolveA(domainName string, msg *dns.Msg) {
 	t.resolveAAt(domainName, msg, 0)
 }
@@ -41,13 +122,13 @@ func (t *Tailscale) resolveCNAME(domainName string, msg *dns.Msg, lookupType int
 }
 
 func (t *Tailscale) resolveAAt(domainName string, msg *dns.Msg, depth int) {
-	name := strings.Split(domainName, ".")[0]
+	name, _ := t.lookup(domainName)
 	entries, ok := t.entries[name]["A"]
 	if ok {
 		log.Debugf("Found an v4 entry after lookup for: %s", name)
 		for _, entry := range entries {
 			msg.Answer = append(msg.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.ttl)},
 				A:   net.ParseIP(entry),
 			})
 		}
@@ -59,13 +140,13 @@ func (t *Tailscale) resolveAAt(domainName string, msg *dns.Msg, depth int) {
 }
 
 func (t *Tailscale) resolveAAAAAt(domainName string, msg *dns.Msg, depth int) {
-	name := strings.Split(domainName, ".")[0]
+	name, _ := t.lookup(domainName)
 	entries, ok := t.entries[name]["AAAA"]
 	if ok {
 		log.Debugf("Found a v6 entry after lookup for: %s", name)
 		for _, entry := range entries {
 			msg.Answer = append(msg.Answer, &dns.AAAA{
-				Hdr:  dns.RR_Header{Name: domainName, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+				Hdr:  dns.RR_Header{Name: domainName, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.ttl)},
 				AAAA: net.ParseIP(entry),
 			})
 		}
@@ -82,13 +163,18 @@ func (t *Tailscale) resolveCNAMEAt(domainName string, msg *dns.Msg, lookupType i
 		return
 	}
 
-	name := strings.Split(domainName, ".")[0]
+	name, _ := t.lookup(domainName)
 	targets, ok := t.entries[name]["CNAME"]
 	if ok {
 		log.Debugf("Found a CNAME entry after lookup for: %s", name)
+		zone, _ := t.zoneOf(domainName)
+		if t.preferOnline {
+			targets = t.onlineTargets(targets)
+		}
 		for _, target := range targets {
+			target = t.qualify(target, zone)
 			msg.Answer = append(msg.Answer, &dns.CNAME{
-				Hdr:    dns.RR_Header{Name: domainName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Hdr:    dns.RR_Header{Name: domainName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.cnameTTL)},
 				Target: target,
 			})
 
@@ -105,12 +191,186 @@ func (t *Tailscale) resolveCNAMEAt(domainName string, msg *dns.Msg, lookupType i
 	}
 }
 
-func (t *Tailscale) handleNoRecords(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg) (int, error) {
+// onlineTargets returns the targets that are not known to be offline, or all
+// targets if none is online.
+func (t *Tailscale) onlineTargets(targets []string) []string {
+	online := make([]string, 0, len(targets))
+	for _, target := range targets {
+		if name, _ := t.lookup(target); !t.offline[name] {
+			online = append(online, target)
+		}
+	}
+	if len(online) == 0 {
+		return targets
+	}
+	return online
+}
+
+func (t *Tailscale) resolveTXT(domainName string, msg *dns.Msg) {
+	name, _ := t.lookup(domainName)
+	entries, ok := t.entries[name]["TXT"]
+	if ok {
+		log.Debugf("Found a TXT entry after lookup for: %s", name)
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.ttl)},
+			Txt: entries,
+		})
+	}
+}
+
+// resolveSRV answers SRV queries for _service._proto names. The targets' local
+// A and AAAA records are added to the additional section.
+func (t *Tailscale) resolveSRV(domainName string, msg *dns.Msg) {
+	name, _ := t.lookup(domainName)
+	entries, ok := t.entries[name]["SRV"]
+	if !ok {
+		return
+	}
+
+	log.Debugf("Found a SRV entry after lookup for: %s", name)
+	zone, _ := t.zoneOf(domainName)
+	for _, entry := range entries {
+		srv, err := t.newSRV(domainName, entry)
+		if err != nil {
+			log.Errorf("Malformed SRV entry %q for %s: %v", entry, name, err)
+			continue
+		}
+		srv.Hdr.Ttl = t.answerTTL(name, t.ttl)
+		srv.Target = t.qualify(srv.Target, zone)
+		msg.Answer = append(msg.Answer, srv)
+
+		extra := dns.Msg{}
+		t.resolveAAt(srv.Target, &extra, 0)
+		t.resolveAAAAAt(srv.Target, &extra, 0)
+		msg.Extra = append(msg.Extra, extra.Answer...)
+	}
+}
+
+// Tailscale assigns node addresses from these ranges, PTR queries are only answered within them.
+var (
+	tailnetPrefix4 = netip.MustParsePrefix("100.64.0.0/10")
+	tailnetPrefix6 = netip.MustParsePrefix("fd7a:115c:a1e0::/48")
+)
+
+func isTailnetAddr(addr netip.Addr) bool {
+	return tailnetPrefix4.Contains(addr) || tailnetPrefix6.Contains(addr)
+}
+
+func (t *Tailscale) resolvePTR(domainName string, msg *dns.Msg) {
+	addr, err := netip.ParseAddr(dnsutil.ExtractAddressFromReverse(strings.ToLower(domainName)))
+	if err != nil || !isTailnetAddr(addr) {
+		return
+	}
+
+	targets, ok := t.reverse[addr]
+	if ok {
+		log.Debugf("Found a PTR entry after lookup for: %s", addr)
+		for _, target := range targets {
+			name, _ := t.lookup(target)
+			msg.Answer = append(msg.Answer, &dns.PTR{
+				Hdr: dns.RR_Header{Name: domainName, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.ttl)},
+				Ptr: target,
+			})
+		}
+	}
+}
+
+// SOA timers of the synthesized zone apex. The SOA minimum is the negative
+// TTL, as that is what caches use for negative answers (RFC 2308).
+const (
+	soaRefresh = 7200
+	soaRetry   = 1800
+	soaExpire  = 86400
+)
+
+func (t *Tailscale) isApex(domainName string) bool {
+	zone, ok := t.zoneOf(domainName)
+	return ok && strings.EqualFold(dns.Fqdn(domainName), dns.Fqdn(zone))
+}
+
+func (t *Tailscale) inZone(domainName string) bool {
+	_, ok := t.zoneOf(domainName)
+	return ok
+}
+
+// exists reports whether domainName is a name in the zone, either because it
+// owns records or because it is an empty non-terminal above one that does
+// (e.g. _tcp.<zone> for _http._tcp.<zone>).
+func (t *Tailscale) exists(domainName string) bool {
+	if t.isApex(domainName) {
+		return true
+	}
+	if _, ok := t.lookup(domainName); ok {
+		return true
+	}
+	name, _ := t.relName(domainName)
+	for entry := range t.entries {
+		if strings.HasSuffix(entry, "."+name) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsName is the name server of the zone. Once the netmap is known that is this
+// node's own name in the zone, so the NS target resolves locally.
+func (t *Tailscale) nsName(zone string) string {
+	if t.self != "" {
+		return dnsutil.Join(t.self, dns.Fqdn(zone))
+	}
+	return dnsutil.Join("ns.dns", dns.Fqdn(zone))
+}
+
+func (t *Tailscale) soa(zone string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: t.negativeTTL},
+		Ns:      t.nsName(zone),
+		Mbox:    dnsutil.Join("hostmaster", dns.Fqdn(zone)),
+		Serial:  t.serial,
+		Refresh: soaRefresh,
+		Retry:   soaRetry,
+		Expire:  soaExpire,
+		Minttl:  t.negativeTTL,
+	}
+}
+
+func (t *Tailscale) resolveSOA(zone string, msg *dns.Msg) {
+	msg.Answer = append(msg.Answer, t.soa(zone))
+}
+
+// resolveNS answers the apex NS query, adding the name server's addresses to
+// the additional section.
+func (t *Tailscale) resolveNS(zone string, msg *dns.Msg) {
+	ns := t.nsName(zone)
+	msg.Answer = append(msg.Answer, &dns.NS{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: t.ttl},
+		Ns:  ns,
+	})
+
+	if t.self != "" {
+		extra := dns.Msg{}
+		t.resolveAAt(ns, &extra, 0)
+		t.resolveAAAAAt(ns, &extra, 0)
+		msg.Extra = append(msg.Extra, extra.Answer...)
+	}
+}
+
+// handleNoRecords writes the negative answer. Names that exist in the zone get
+// NODATA, everything else NXDOMAIN unless fallthrough applies. msg already
+// carries the SOA in its authority section for names in the zone.
+func (t *Tailscale) handleNoRecords(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, msg *dns.Msg, nodata bool) (int, error) {
+	if nodata {
+		log.Debugf("Writing NODATA response: %+v", msg)
+		w.WriteMsg(msg)
+		return dns.RcodeSuccess, nil
+	}
+
 	if t.fall.Through(r.Question[0].Name) {
 		log.Debug("falling through")
 		return plugin.NextOrFailure(t.Name(), t.next, ctx, w, r)
 	}
 
+	msg.Rcode = dns.RcodeNameError
 	log.Debugf("Writing response: %+v", msg)
 	w.WriteMsg(msg)
 	return dns.RcodeNameError, nil
@@ -129,14 +389,27 @@ func (t *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 
 	name := r.Question[0].Name
 
-	parts := strings.SplitN(name, ".", 2)
+	t.mu.RLock()
+	// Metrics of names outside all zones, like PTR queries, count towards the primary zone.
+	zone, ok := t.zoneOf(name)
+	if !ok {
+		zone = t.zone
+	}
+	if t.isApex(name) {
+		switch r.Question[0].Qtype {
+		case dns.TypeSOA:
+			log.Debug("Handling SOA record lookup")
+			t.resolveSOA(zone, &msg)
 
-	// Answer only in cases when the zone matches. The len check guards against
-	// malformed names with no separator (e.g. an empty Name or a bare label),
-	// which would otherwise panic on parts[1].
-	if len(parts) == 2 && parts[1] == t.zone {
-		t.mu.RLock()
-		defer t.mu.RUnlock()
+		case dns.TypeNS:
+			log.Debug("Handling NS record lookup")
+			t.resolveNS(zone, &msg)
+		}
+	} else if label, ok := t.routeQuery(name); ok {
+		log.Debug("Handling route lookup")
+		t.resolveRoute(name, label, r.Question[0].Qtype, &msg)
+	} else if _, ok := t.relName(name); ok {
+		// Answer only in cases when the zone matches.
 		switch r.Question[0].Qtype {
 		case dns.TypeA:
 			log.Debug("Handling A record lookup")
@@ -149,27 +422,59 @@ func (t *Tailscale) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.M
 		case dns.TypeCNAME:
 			log.Debug("Handling CNAME record lookup")
 			t.resolveCNAME(name, &msg, TypeAll)
+
+		case dns.TypeTXT:
+			log.Debug("Handling TXT record lookup")
+			t.resolveTXT(name, &msg)
+
+		case dns.TypeSRV:
+			log.Debug("Handling SRV record lookup")
+			t.resolveSRV(name, &msg)
+		}
+	} else if r.Question[0].Qtype == dns.TypePTR {
+		log.Debug("Handling PTR record lookup")
+		t.resolvePTR(name, &msg)
+		if len(msg.Answer) == 0 && t.routes {
+			t.resolveDelegation(name, &msg)
 		}
 	}
 
-	if len(msg.Answer) == 0 {
+	// A referral has no answer, but delegation records in the authority section.
+	referral := len(msg.Answer) == 0 && len(msg.Ns) > 0
+	nodata := false
+	if len(msg.Answer) == 0 && !referral && t.inZone(name) {
+		msg.Ns = []dns.RR{t.soa(zone)}
+		nodata = t.exists(name)
+	}
+	if t.stale {
+		t.markStale(r, &msg)
+	}
+	t.mu.RUnlock()
+
+	if len(msg.Answer) == 0 && !referral {
 		// Determine the result label before calling handleNoRecords so we can
 		// capture it regardless of the outcome.
 		result := "nxdomain"
-		if t.fall.Through(r.Question[0].Name) {
+		if nodata {
+			result = "nodata"
+		} else if t.fall.Through(r.Question[0].Name) {
 			result = "fallthrough"
 		}
-		rcode, err := t.handleNoRecords(ctx, w, r, &msg)
+		rcode, err := t.handleNoRecords(ctx, w, r, &msg, nodata)
 		if rcode == dns.RcodeServerFailure {
 			result = "servfail"
 		}
-		requestsTotal.WithLabelValues(t.zone, qtypeStr, result).Inc()
-		requestDuration.WithLabelValues(t.zone, qtypeStr).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(zone, qtypeStr, result).Inc()
+		requestDuration.WithLabelValues(zone, qtypeStr).Observe(time.Since(start).Seconds())
 		return rcode, err
 	}
 
-	requestsTotal.WithLabelValues(t.zone, qtypeStr, "success").Inc()
-	requestDuration.WithLabelValues(t.zone, qtypeStr).Observe(time.Since(start).Seconds())
+	result := "success"
+	if referral {
+		result = "referral"
+	}
+	requestsTotal.WithLabelValues(zone, qtypeStr, result).Inc()
+	requestDuration.WithLabelValues(zone, qtypeStr).Observe(time.Since(start).Seconds())
 
 	log.Debugf("Writing response: %+v", msg)
 	w.WriteMsg(&msg)
@@ -2,10 +2,13 @@ package tailscale
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"net/netip"
 	"reflect"
 	"sort"
 	"testing"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
@@ -17,11 +20,15 @@ import (
 
 func newTS() Tailscale {
 	return Tailscale{
-		zone: "example.com",
+		zone:        "example.com",
+		ttl:         defaultTTL,
+		cnameTTL:    defaultTTL,
+		negativeTTL: defaultTTL,
 		entries: map[string]map[string][]string{
 			"test1": {
 				"A":    []string{"127.0.0.1"},
 				"AAAA": []string{"::1"},
+				"TXT":  []string{"os=linux", "tags=tag:web"},
 			},
 			"test2-1": {
 				"A":    []string{"127.0.0.1"},
@@ -34,6 +41,13 @@ func newTS() Tailscale {
 			"test2": {
 				"CNAME": []string{"test2-1.example.com", "test2-2.example.com"},
 			},
+			"_http._tcp": {
+				"SRV": []string{"0 0 8080 test1.example.com"},
+			},
+		},
+		reverse: map[netip.Addr][]string{
+			netip.MustParseAddr("100.64.0.1"):        {"test1.example.com."},
+			netip.MustParseAddr("fd7a:115c:a1e0::1"): {"test1.example.com."},
 		},
 	}
 }
@@ -255,6 +269,357 @@ func TestResolveAAAAIsCNAME(t *testing.T) {
 	testEquals(t, "AAAA record", []string{"::1", "::1"}, aaaas)
 }
 
+func TestResolvePTR(t *testing.T) {
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"1.0.64.100.in-addr.arpa.", []string{"test1.example.com."}},
+		{"1.0.64.100.IN-ADDR.ARPA.", []string{"test1.example.com."}},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", []string{"test1.example.com."}},
+		// In the tailnet range, but not in the netmap.
+		{"2.0.64.100.in-addr.arpa.", nil},
+		// Outside of the tailnet range.
+		{"1.0.0.127.in-addr.arpa.", nil},
+		{"not-a-reverse.example.com.", nil},
+	}
+
+	ts := newTS()
+	for _, tc := range tests {
+		msg := dns.Msg{}
+		ts.resolvePTR(tc.name, &msg)
+
+		var got []string
+		for _, rr := range msg.Answer {
+			got = append(got, rr.(*dns.PTR).Ptr)
+		}
+		testEquals(t, "PTR records for "+tc.name, tc.want, got)
+	}
+}
+
+func TestServeDNSPTR(t *testing.T) {
+	ts := newTS()
+
+	var msg dns.Msg
+	msg.SetQuestion("1.0.64.100.in-addr.arpa.", dns.TypePTR)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err := ts.ServeDNS(context.Background(), w, &msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := dns.RcodeSuccess, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+	if want, got := "test1.example.com.", w.Msg.Answer[0].(*dns.PTR).Ptr; got != want {
+		t.Errorf("want %s, got: %s", want, got)
+	}
+
+	// Unknown addresses fall through to the next plugin.
+	ts.fall.SetZonesFromArgs(nil)
+	ts.next = test.NextHandler(dns.RcodeRefused, nil)
+	msg.SetQuestion("2.0.64.100.in-addr.arpa.", dns.TypePTR)
+	resp, _ = ts.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), &msg)
+	if want, got := dns.RcodeRefused, resp; got != want {
+		t.Fatalf("want response code %d from next plugin, got %d", want, got)
+	}
+}
+
+func TestServeDNSSRV(t *testing.T) {
+	ts := newTS()
+
+	var msg dns.Msg
+	msg.SetQuestion("_http._tcp.example.com", dns.TypeSRV)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err := ts.ServeDNS(context.Background(), w, &msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, got := dns.RcodeSuccess, resp; got != want {
+		t.Fatalf("want response code %d, got %d", want, got)
+	}
+
+	testEquals(t, "answer count", 1, len(w.Msg.Answer))
+	srv := w.Msg.Answer[0].(*dns.SRV)
+	testEquals(t, "SRV port", uint16(8080), srv.Port)
+	testEquals(t, "SRV target", "test1.example.com", srv.Target)
+
+	// The target's addresses are added as glue.
+	testEquals(t, "extra count", 2, len(w.Msg.Extra))
+}
+
+func TestServeDNSTXT(t *testing.T) {
+	ts := newTS()
+
+	var msg dns.Msg
+	msg.SetQuestion("test1.example.com", dns.TypeTXT)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	testEquals(t, "answer count", 1, len(w.Msg.Answer))
+	testEquals(t, "TXT", []string{"os=linux", "tags=tag:web"}, w.Msg.Answer[0].(*dns.TXT).Txt)
+}
+
+func TestServeDNSApex(t *testing.T) {
+	ts := newTS()
+	ts.self = "test1"
+	ts.serial = 1234
+
+	var msg dns.Msg
+	msg.SetQuestion("example.com.", dns.TypeSOA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "answer count", 1, len(w.Msg.Answer))
+	soa := w.Msg.Answer[0].(*dns.SOA)
+	testEquals(t, "SOA ns", "test1.example.com.", soa.Ns)
+	testEquals(t, "SOA mbox", "hostmaster.example.com.", soa.Mbox)
+	testEquals(t, "SOA serial", uint32(1234), soa.Serial)
+
+	msg.SetQuestion("example.com.", dns.TypeNS)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "answer count", 1, len(w.Msg.Answer))
+	testEquals(t, "NS", "test1.example.com.", w.Msg.Answer[0].(*dns.NS).Ns)
+	testEquals(t, "extra count", 2, len(w.Msg.Extra))
+
+	// Other types at the apex are NODATA.
+	msg.SetQuestion("example.com.", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, _ := ts.ServeDNS(context.Background(), w, &msg)
+	testEquals(t, "rcode", dns.RcodeSuccess, resp)
+	testEquals(t, "answer count", 0, len(w.Msg.Answer))
+	testEquals(t, "authority count", 1, len(w.Msg.Ns))
+}
+
+func TestServeDNSNegative(t *testing.T) {
+	tests := []struct {
+		name   string
+		qtype  uint16
+		rcode  int
+		result string
+	}{
+		// test2-1 exists, but has no MX.
+		{"test2-1.example.com", dns.TypeMX, dns.RcodeSuccess, "nodata"},
+		// _tcp is an empty non-terminal above _http._tcp.
+		{"_tcp.example.com", dns.TypeSRV, dns.RcodeSuccess, "nodata"},
+	}
+
+	// NODATA is a final answer, it must not fall through.
+	ts := newTS()
+	ts.fall.SetZonesFromArgs(nil)
+	for _, tc := range tests {
+		before := testutil.ToFloat64(requestsTotal.WithLabelValues("example.com", dns.TypeToString[tc.qtype], tc.result))
+
+		var msg dns.Msg
+		msg.SetQuestion(tc.name, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		resp, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		testEquals(t, tc.name+" rcode", tc.rcode, resp)
+		testEquals(t, tc.name+" msg rcode", tc.rcode, w.Msg.Rcode)
+		testEquals(t, tc.name+" answer count", 0, len(w.Msg.Answer))
+		testEquals(t, tc.name+" authority", dns.TypeSOA, w.Msg.Ns[0].Header().Rrtype)
+		if got := testutil.ToFloat64(requestsTotal.WithLabelValues("example.com", dns.TypeToString[tc.qtype], tc.result)); got != before+1 {
+			t.Errorf("%s: requestsTotal %s = %v, want %v", tc.name, tc.result, got, before+1)
+		}
+	}
+
+	// Without fallthrough, absent names get NXDOMAIN with the SOA.
+	ts = newTS()
+	var msg dns.Msg
+	msg.SetQuestion("test3.example.com", dns.TypeAAAA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, _ := ts.ServeDNS(context.Background(), w, &msg)
+	testEquals(t, "rcode", dns.RcodeNameError, resp)
+	testEquals(t, "msg rcode", dns.RcodeNameError, w.Msg.Rcode)
+	testEquals(t, "authority", dns.TypeSOA, w.Msg.Ns[0].Header().Rrtype)
+}
+
+func TestServeDNSCaseInsensitive(t *testing.T) {
+	ts := newTS()
+
+	var msg dns.Msg
+	msg.SetQuestion("TEST1.Example.COM.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	resp, err := ts.ServeDNS(context.Background(), w, &msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "rcode", dns.RcodeSuccess, resp)
+	testEquals(t, "answer count", 1, len(w.Msg.Answer))
+	// The owner name keeps the case of the question.
+	testEquals(t, "owner", "TEST1.Example.COM.", w.Msg.Answer[0].Header().Name)
+}
+
+func TestServeDNSWildcard(t *testing.T) {
+	tests := []struct {
+		name     string
+		qtype    uint16
+		wildcard bool
+		answers  int
+		rcode    int
+	}{
+		{"foo.test1.example.com.", dns.TypeA, true, 1, dns.RcodeSuccess},
+		{"*.test1.example.com.", dns.TypeAAAA, true, 1, dns.RcodeSuccess},
+		{"a.b.test1.example.com.", dns.TypeA, true, 1, dns.RcodeSuccess},
+		// Wildcards below a CNAME follow it.
+		{"foo.test2.example.com.", dns.TypeA, true, 4, dns.RcodeSuccess},
+		// Names below a node exist, so other types are NODATA.
+		{"foo.test1.example.com.", dns.TypeMX, true, 0, dns.RcodeSuccess},
+		{"foo.test3.example.com.", dns.TypeA, true, 0, dns.RcodeNameError},
+		{"foo.test1.example.com.", dns.TypeA, false, 0, dns.RcodeNameError},
+		// Shared nodes named after their tailnet have more than one label.
+		{"foo.host.tail1234.example.com.", dns.TypeA, true, 1, dns.RcodeSuccess},
+		{"a.b.host.tail1234.example.com.", dns.TypeA, true, 1, dns.RcodeSuccess},
+		{"foo.other.tail1234.example.com.", dns.TypeA, true, 0, dns.RcodeNameError},
+		// Service entries don't answer for names below them.
+		{"foo._http._tcp.example.com.", dns.TypeSRV, true, 0, dns.RcodeNameError},
+	}
+
+	for _, tc := range tests {
+		ts := newTS()
+		ts.wildcard = tc.wildcard
+		ts.entries["host.tail1234"] = map[string][]string{"A": {"100.64.0.5"}}
+
+		var msg dns.Msg
+		msg.SetQuestion(tc.name, tc.qtype)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		resp, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		testEquals(t, tc.name+" rcode", tc.rcode, resp)
+		testEquals(t, tc.name+" answer count", tc.answers, len(w.Msg.Answer))
+	}
+}
+
+func TestServeDNSTTL(t *testing.T) {
+	ts := newTS()
+	ts.ttl = 300
+	ts.cnameTTL = 600
+	ts.negativeTTL = 5
+	ts.changedTTL = 10
+	ts.changedWindow = time.Minute
+	ts.changed = map[string]time.Time{"test2-1": time.Now()}
+
+	var msg dns.Msg
+	msg.SetQuestion("test2.example.com.", dns.TypeA)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ttls := map[string]uint32{}
+	for _, rr := range w.Msg.Answer {
+		ttls[rr.Header().Name] = rr.Header().Ttl
+	}
+	// test2-1 changed recently, test2-2 didn't.
+	want := map[string]uint32{"test2.example.com.": 600, "test2-1.example.com": 10, "test2-2.example.com": 300}
+	testEquals(t, "TTLs", want, ttls)
+
+	msg.SetQuestion("test3.example.com.", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	ts.ServeDNS(context.Background(), w, &msg)
+	soa := w.Msg.Ns[0].(*dns.SOA)
+	testEquals(t, "SOA TTL", uint32(5), soa.Hdr.Ttl)
+	testEquals(t, "SOA minttl", uint32(5), soa.Minttl)
+
+	// Every record type of a changed name gets the lowered TTL.
+	ts.changed = map[string]time.Time{"test1": time.Now(), "_http._tcp": time.Now()}
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"test1.example.com.", dns.TypeTXT},
+		{"_http._tcp.example.com.", dns.TypeSRV},
+		{"1.0.64.100.in-addr.arpa.", dns.TypePTR},
+	} {
+		msg.SetQuestion(q.name, q.qtype)
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		ts.ServeDNS(context.Background(), w, &msg)
+		if len(w.Msg.Answer) == 0 {
+			t.Fatalf("%s %s: no answer", q.name, dns.TypeToString[q.qtype])
+		}
+		testEquals(t, q.name+" TTL", uint32(10), w.Msg.Answer[0].Header().Ttl)
+	}
+}
+
+func TestServeDNSMultipleZones(t *testing.T) {
+	ts := newTS()
+	ts.zones = []string{"example.org"}
+	ts.magicDNSZone = "tail1234.ts.net"
+
+	for _, zone := range []string{"example.com", "example.org", "tail1234.ts.net"} {
+		successBefore := testutil.ToFloat64(requestsTotal.WithLabelValues(zone, "A", "success"))
+
+		var msg dns.Msg
+		msg.SetQuestion("test2."+zone+".", dns.TypeA)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		resp, err := ts.ServeDNS(context.Background(), w, &msg)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", zone, err)
+		}
+		testEquals(t, zone+" rcode", dns.RcodeSuccess, resp)
+		testEquals(t, zone+" answer count", 4, len(w.Msg.Answer))
+
+		// CNAME targets stay within the queried zone.
+		for _, rr := range w.Msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && !dns.IsSubDomain(zone+".", dns.Fqdn(cname.Target)) {
+				t.Errorf("%s: CNAME target %s outside the zone", zone, cname.Target)
+			}
+		}
+		if got := testutil.ToFloat64(requestsTotal.WithLabelValues(zone, "A", "success")); got != successBefore+1 {
+			t.Errorf("%s: requestsTotal success = %v, want %v", zone, got, successBefore+1)
+		}
+
+		msg.SetQuestion(zone+".", dns.TypeSOA)
+		w = dnstest.NewRecorder(&test.ResponseWriter{})
+		ts.ServeDNS(context.Background(), w, &msg)
+		testEquals(t, zone+" SOA owner", zone+".", w.Msg.Answer[0].Header().Name)
+	}
+}
+
+func TestServeDNSPreferOnline(t *testing.T) {
+	tests := []struct {
+		offline map[string]bool
+		prefer  bool
+		want    []string
+	}{
+		{map[string]bool{"test2-1": true}, true, []string{"test2-2.example.com"}},
+		{map[string]bool{"test2-1": true}, false, []string{"test2-1.example.com", "test2-2.example.com"}},
+		// With all targets offline, all are returned.
+		{map[string]bool{"test2-1": true, "test2-2": true}, true, []string{"test2-1.example.com", "test2-2.example.com"}},
+	}
+
+	for i, tc := range tests {
+		ts := newTS()
+		ts.offline = tc.offline
+		ts.preferOnline = tc.prefer
+
+		var msg dns.Msg
+		msg.SetQuestion("test2.example.com.", dns.TypeCNAME)
+		w := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+
+		var got []string
+		for _, rr := range w.Msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok {
+				got = append(got, cname.Target)
+			}
+		}
+		testEquals(t, fmt.Sprintf("test %d CNAME targets", i), tc.want, got)
+	}
+}
+
 // TestResolveCNAMECycle ensures a self-referencing CNAME (or any cycle) does
 // not blow the goroutine stack. Pre-fix this would recurse unboundedly and
 // panic; the depth bound caps the chain at maxCNAMEDepth and returns cleanly.
@@ -0,0 +1,82 @@
+package tailscale
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"tailscale.com/types/netmap"
+)
+
+// tailnetServices returns the Tailscale Services of the netmap by name,
+// without the "svc:" prefix, with their virtual addresses. Services hosted by
+// this node come from its service-host capability. Services of other nodes are
+// the MagicDNS records of the netmap that name a single label below the
+// MagicDNS domain and point at a virtual address, one a peer is routed but
+// doesn't own.
+func tailnetServices(nm *netmap.NetworkMap) map[string][]netip.Addr {
+	services := map[string][]netip.Addr{}
+	for svc, addrs := range nm.GetVIPServiceIPMap() {
+		if name := svc.WithoutPrefix(); name != "" {
+			services[strings.ToLower(name)] = slices.Clone(addrs)
+		}
+	}
+
+	vips := map[netip.Addr]bool{}
+	for _, peer := range nm.Peers {
+		for _, pfx := range peer.AllowedIPs().AsSlice() {
+			if pfx.IsSingleIP() && !slices.Contains(peer.Addresses().AsSlice(), pfx) {
+				vips[pfx.Addr()] = true
+			}
+		}
+	}
+
+	suffix := strings.ToLower(nm.MagicDNSSuffix())
+	for _, rec := range nm.DNS.ExtraRecords {
+		if rec.Type != "" && rec.Type != "A" && rec.Type != "AAAA" {
+			continue
+		}
+		fqdn := strings.ToLower(strings.TrimSuffix(rec.Name, "."))
+		name, ok := strings.CutSuffix(fqdn, "."+suffix)
+		if !ok || suffix == "" || name == "" || strings.Contains(name, ".") {
+			continue
+		}
+		addr, err := netip.ParseAddr(rec.Value)
+		if err != nil || !vips[addr] || slices.Contains(services[name], addr) {
+			continue
+		}
+		services[name] = append(services[name], addr)
+	}
+	return services
+}
+
+// addServices names the Tailscale Services <service>.<zone>. Names already
+// taken by nodes are left to them. It returns how many services were added.
+func (t *Tailscale) addServices(entries map[string]map[string][]string, reverse map[netip.Addr][]string, services map[string][]netip.Addr) int {
+	added := 0
+	for _, name := range slices.Sorted(maps.Keys(services)) {
+		if _, ok := entries[name]; ok {
+			log.Warningf("Skipping Tailscale Service svc:%s, the name %s.%s is already taken", name, name, t.zone)
+			continue
+		}
+
+		addrs := services[name]
+		slices.SortFunc(addrs, netip.Addr.Compare)
+		entry := map[string][]string{}
+		for _, addr := range addrs {
+			if addr.Is4() {
+				entry["A"] = append(entry["A"], addr.String())
+			} else {
+				entry["AAAA"] = append(entry["AAAA"], addr.String())
+			}
+			if isTailnetAddr(addr) {
+				reverse[addr] = append(reverse[addr], fmt.Sprintf("%s.%s.", name, t.zone))
+			}
+		}
+		entries[name] = entry
+		added++
+	}
+	return added
+}
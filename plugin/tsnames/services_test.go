@@ -0,0 +1,77 @@
+package tailscale
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestProcessNetMapServices(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var p []netip.Prefix
+		for _, s := range s {
+			p = append(p, netip.MustParsePrefix(s))
+		}
+		return p
+	}
+
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ID:           1,
+			ComputedName: "self",
+			Name:         "self.tail1234.ts.net.",
+			Addresses:    prefixes("100.64.0.1/32"),
+			CapMap: tailcfg.NodeCapMap{
+				tailcfg.NodeAttrServiceHost: {`{"svc:metrics":["100.100.0.3"]}`},
+			},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ID:           2,
+				ComputedName: "web",
+				Name:         "web.tail1234.ts.net.",
+				Addresses:    prefixes("100.64.0.2/32"),
+				AllowedIPs:   prefixes("100.64.0.2/32", "100.100.0.1/32", "100.100.0.2/32"),
+			}).View(),
+		},
+		DNS: tailcfg.DNSConfig{ExtraRecords: []tailcfg.DNSRecord{
+			{Name: "Git.tail1234.ts.net.", Value: "100.100.0.1"},
+			// Taken by the node of the same name.
+			{Name: "web.tail1234.ts.net.", Value: "100.100.0.2"},
+			// No virtual address, a record of the tailnet admin.
+			{Name: "printer.tail1234.ts.net.", Value: "192.168.1.5"},
+			// Not below the MagicDNS domain.
+			{Name: "git.example.org.", Value: "100.100.0.1"},
+		}},
+	}
+
+	ts := &Tailscale{zone: "services.example", services: true}
+	ts.processNetMap(nm)
+
+	got := map[string][]string{}
+	for name, entry := range ts.entries {
+		got[name] = entry["A"]
+	}
+	want := map[string][]string{
+		"self":    {"100.64.0.1"},
+		"web":     {"100.64.0.2"},
+		"git":     {"100.100.0.1"},
+		"metrics": {"100.100.0.3"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("entries mismatch (-want +got):\n%s", diff)
+	}
+	if got := ts.reverse[netip.MustParseAddr("100.100.0.1")]; len(got) != 1 || got[0] != "git.services.example." {
+		t.Errorf("PTR of 100.100.0.1 = %v, want git.services.example.", got)
+	}
+	if got := testutil.ToFloat64(sourceEntriesGauge.WithLabelValues("services.example", "service")); got != 2 {
+		t.Errorf("service entries = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(sourceEntriesGauge.WithLabelValues("services.example", "tailnet")); got != 2 {
+		t.Errorf("tailnet entries = %v, want 2", got)
+	}
+}
@@ -1,45 +1,287 @@
 package tailscale
 
 import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	ts "github.com/coredns/coredns/plugin/tailscale"
+	"github.com/coredns/coredns/plugin/transfer"
+
+	"github.com/miekg/dns"
 )
 
+// defaultSRVPrefix is the tag prefix used by the srv directive when none is given.
+const defaultSRVPrefix = "srv-"
+
+// defaultTTL is the TTL of all records unless configured otherwise.
+const defaultTTL = 60
+
+// maxTTL bounds configured TTLs, mirroring the kubernetes plugin.
+const maxTTL = 3600
+
 // init registers this plugin.
 func init() { plugin.Register("tsnames", setup) }
 
 // setup is the function that gets called when the config parser see the token "example". Setup is responsible
 // for parsing any extra options the example plugin may have. The first token this function sees is "example".
 func setup(c *caddy.Controller) error {
-	ts := &Tailscale{}
+	t, err := parse(c)
+	if err != nil {
+		return plugin.Error("tsnames", err)
+	}
+
+	// The netmap watcher stops with this instance, a reload starts a new one.
+	ctx, cancel := context.WithCancel(context.Background())
+	c.OnShutdown(func() error {
+		cancel()
+		return nil
+	})
+
+	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		t.next = next
+		return t
+	})
+
+	// Serve what is known right away, the watcher only runs once the
+	// instance started.
+	c.OnStartup(t.load)
+	ts.OnStarted(c, func() { go t.watchIPNBus(ctx) })
+
+	// Get the transfer plugin, so we can send notifies when the tailnet changes.
+	c.OnStartup(func() error {
+		x := dnsserver.GetConfig(c).Handler("transfer")
+		if x == nil {
+			return nil
+		}
+		t.mu.Lock()
+		t.xfer = x.(*transfer.Transfer) // if found this must be OK.
+		t.mu.Unlock()
+		return nil
+	})
+
+	// All OK, return a nil error.
+	return nil
+}
+
+// parse reads the tsnames block. It is split out of setup so it can be tested
+// without starting the netmap watcher.
+func parse(c *caddy.Controller) (*Tailscale, error) {
+	ts := &Tailscale{ttl: defaultTTL, cnameTTL: defaultTTL, negativeTTL: defaultTTL, staleTTL: defaultStaleTTL}
 	for c.Next() {
 		args := c.RemainingArgs()
-		if len(args) != 1 {
-			return plugin.Error("tsnames", c.ArgErr())
+		if len(args) == 0 {
+			return nil, c.ArgErr()
+		}
+		// Keep the zones in their canonical form, queries are matched case-insensitively.
+		for i, arg := range args {
+			zone := strings.TrimSuffix(strings.ToLower(arg), ".")
+			if i == 0 {
+				ts.zone = zone
+			} else {
+				ts.zones = append(ts.zones, zone)
+			}
 		}
-		ts.zone = args[0]
 
 		for c.NextBlock() {
 			switch c.Val() {
 			case "fallthrough":
 				ts.fall.SetZonesFromArgs(c.RemainingArgs())
+			case "srv":
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 0:
+					ts.srvPrefix = defaultSRVPrefix
+				case 1:
+					ts.srvPrefix = args[0]
+				default:
+					return nil, c.ArgErr()
+				}
+			case "txt":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.txt = true
+			case "override":
+				args := c.RemainingArgs()
+				if len(args) != 3 {
+					return nil, c.ArgErr()
+				}
+				name, typ, value, err := parseOverride(ts.zone, args)
+				if err != nil {
+					return nil, c.Errf("override: %v", err)
+				}
+				if ts.overrides == nil {
+					ts.overrides = map[string]map[string][]string{}
+				}
+				if _, ok := ts.overrides[name]; !ok {
+					ts.overrides[name] = map[string][]string{}
+				}
+				ts.overrides[name][typ] = append(ts.overrides[name][typ], value)
+			case "routes":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.routes = true
+			case "omit":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				switch {
+				case args[0] == "offline" && len(args) == 1:
+					ts.omitOffline = true
+				case args[0] == "expired" && len(args) == 1:
+					ts.omitExpired = true
+				case args[0] == "unseen" && len(args) == 2:
+					d, err := time.ParseDuration(args[1])
+					if err != nil || d <= 0 {
+						return nil, c.Errf("omit unseen: invalid duration %q", args[1])
+					}
+					ts.omitUnseen = d
+				default:
+					return nil, c.ArgErr()
+				}
+			case "prefer_online":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.preferOnline = true
+			case "magicdns":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.magicDNS = true
+			case "wildcard":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.wildcard = true
+			case "ttl", "cname_ttl", "negative_ttl":
+				directive := c.Val()
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, c.ArgErr()
+				}
+				ttl, err := parseTTL(args[0])
+				if err != nil {
+					return nil, c.Errf("%s: %v", directive, err)
+				}
+				switch directive {
+				case "ttl":
+					ts.ttl = ttl
+				case "cname_ttl":
+					ts.cnameTTL = ttl
+				case "negative_ttl":
+					ts.negativeTTL = ttl
+				}
+			case "changed_ttl":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				ttl, err := parseTTL(args[0])
+				if err != nil {
+					return nil, c.Errf("changed_ttl: %v", err)
+				}
+				window, err := time.ParseDuration(args[1])
+				if err != nil || window <= 0 {
+					return nil, c.Errf("changed_ttl: invalid window %q", args[1])
+				}
+				ts.changedTTL = ttl
+				ts.changedWindow = window
+			case "snapshot":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				ts.snapshotFile = args[0]
+				if len(args) == 2 {
+					ttl, err := parseTTL(args[1])
+					if err != nil {
+						return nil, c.Errf("snapshot: %v", err)
+					}
+					ts.staleTTL = ttl
+				}
+			case "stale_ede":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.staleEDE = true
+			case "shared":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					args = []string{sharedSubdomain}
+				}
+				switch {
+				case args[0] == sharedSubdomain && len(args) == 1:
+				case args[0] == sharedPrefix && len(args) == 2:
+					ts.sharedPrefix = strings.ToLower(args[1])
+				default:
+					return nil, c.ArgErr()
+				}
+				ts.shared = args[0]
+			case "services":
+				if c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				ts.services = true
 			default:
-				return plugin.Error("tsnames", c.ArgErr())
+				return nil, c.ArgErr()
 			}
 		}
 	}
 
-	// Add the Plugin to CoreDNS, so Servers can use it in their plugin chain.
-	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		ts.next = next
-		if err := ts.start(); err != nil {
-			log.Error(err)
-			return nil
+	return ts, nil
+}
+
+// parseOverride parses the NAME TYPE VALUE arguments of an override into the
+// entry form. NAME is relative to the zone, or a fully qualified name in it.
+func parseOverride(zone string, args []string) (name, typ, value string, err error) {
+	name = strings.ToLower(args[0])
+	if dns.IsFqdn(name) {
+		rel, ok := strings.CutSuffix(name, "."+dns.Fqdn(zone))
+		if !ok {
+			return "", "", "", fmt.Errorf("%s is not in zone %s", args[0], zone)
 		}
-		return ts
-	})
+		name = rel
+	}
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		return "", "", "", fmt.Errorf("invalid name %q", args[0])
+	}
 
-	// All OK, return a nil error.
-	return nil
+	typ = strings.ToUpper(args[1])
+	switch typ {
+	case "A", "AAAA":
+		addr, err := netip.ParseAddr(args[2])
+		if err != nil || addr.Is4() != (typ == "A") || addr.Zone() != "" {
+			return "", "", "", fmt.Errorf("invalid %s address %q", typ, args[2])
+		}
+		return name, typ, addr.String(), nil
+	case "CNAME":
+		if _, ok := dns.IsDomainName(args[2]); !ok {
+			return "", "", "", fmt.Errorf("invalid CNAME target %q", args[2])
+		}
+		return name, typ, strings.ToLower(dns.Fqdn(args[2])), nil
+	}
+	return "", "", "", fmt.Errorf("unsupported record type %q, expected A, AAAA or CNAME", args[1])
+}
+
+// parseTTL parses a TTL in seconds.
+func parseTTL(arg string) (uint32, error) {
+	ttl, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid TTL %q", arg)
+	}
+	if ttl > maxTTL {
+		return 0, fmt.Errorf("TTL %d is larger than %d", ttl, maxTTL)
+	}
+	return uint32(ttl), nil
 }
@@ -0,0 +1,198 @@
+package tailscale
+
+import (
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		srvPrefix string
+		txt       bool
+		wildcard  bool
+		shared    string
+		prefix    string
+		services  bool
+	}{
+		{input: "tsnames example.com"},
+		{input: "tsnames example.com {\n fallthrough\n}"},
+		{input: "tsnames example.com {\n srv\n}", srvPrefix: "srv-"},
+		{input: "tsnames example.com {\n srv svc-\n txt\n}", srvPrefix: "svc-", txt: true},
+		{input: "tsnames Example.COM."},
+		{input: "tsnames example.com {\n wildcard\n}", wildcard: true},
+		{input: "tsnames example.com {\n shared\n}", shared: "subdomain"},
+		{input: "tsnames example.com {\n shared prefix EXT-\n}", shared: "prefix", prefix: "ext-"},
+		{input: "tsnames example.com {\n services\n}", services: true},
+		{input: "tsnames example.com {\n ttl 30\n cname_ttl 300\n negative_ttl 5\n changed_ttl 10 5m\n}"},
+		{input: "tsnames example.com {\n routes\n}"},
+		{input: "tsnames example.com {\n snapshot /var/lib/coredns/tsnames.json\n}"},
+		{input: "tsnames example.com {\n snapshot tsnames.json 30\n stale_ede\n}"},
+		{input: "tsnames example.com {\n omit offline\n omit expired\n omit unseen 24h\n prefer_online\n}"},
+		// Error cases.
+		{input: "tsnames example.com {\n omit\n}", shouldErr: true},
+		{input: "tsnames example.com {\n omit offline 1h\n}", shouldErr: true},
+		{input: "tsnames example.com {\n omit unseen\n}", shouldErr: true},
+		{input: "tsnames example.com {\n omit unseen -1h\n}", shouldErr: true},
+		{input: "tsnames example.com {\n prefer_online yes\n}", shouldErr: true},
+		{input: "tsnames example.com {\n routes all\n}", shouldErr: true},
+		{input: "tsnames example.com {\n snapshot\n}", shouldErr: true},
+		{input: "tsnames example.com {\n snapshot f 10 20\n}", shouldErr: true},
+		{input: "tsnames example.com {\n snapshot f soon\n}", shouldErr: true},
+		{input: "tsnames example.com {\n stale_ede yes\n}", shouldErr: true},
+		{input: "tsnames example.com {\n ttl\n}", shouldErr: true},
+		{input: "tsnames example.com {\n ttl -1\n}", shouldErr: true},
+		{input: "tsnames example.com {\n negative_ttl 3601\n}", shouldErr: true},
+		{input: "tsnames example.com {\n changed_ttl 10\n}", shouldErr: true},
+		{input: "tsnames example.com {\n changed_ttl 10 soon\n}", shouldErr: true},
+		{input: "tsnames example.com {\n shared prefix\n}", shouldErr: true},
+		{input: "tsnames example.com {\n shared subdomain x\n}", shouldErr: true},
+		{input: "tsnames example.com {\n shared bogus\n}", shouldErr: true},
+		{input: "tsnames example.com {\n wildcard yes\n}", shouldErr: true},
+		{input: "tsnames example.com {\n services all\n}", shouldErr: true},
+		{input: "tsnames", shouldErr: true},
+		{input: "tsnames example.com {\n srv a b\n}", shouldErr: true},
+		{input: "tsnames example.com {\n txt yes\n}", shouldErr: true},
+		{input: "tsnames example.com {\n bogus\n}", shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		c := caddy.NewTestController("dns", tc.input)
+		ts, err := parse(c)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if ts.zone != "example.com" {
+			t.Errorf("test %d: zone = %q, want example.com", i, ts.zone)
+		}
+		if ts.srvPrefix != tc.srvPrefix {
+			t.Errorf("test %d: srvPrefix = %q, want %q", i, ts.srvPrefix, tc.srvPrefix)
+		}
+		if ts.txt != tc.txt {
+			t.Errorf("test %d: txt = %v, want %v", i, ts.txt, tc.txt)
+		}
+		if ts.wildcard != tc.wildcard {
+			t.Errorf("test %d: wildcard = %v, want %v", i, ts.wildcard, tc.wildcard)
+		}
+		if ts.shared != tc.shared || ts.sharedPrefix != tc.prefix {
+			t.Errorf("test %d: shared = %q %q, want %q %q", i, ts.shared, ts.sharedPrefix, tc.shared, tc.prefix)
+		}
+		if ts.services != tc.services {
+			t.Errorf("test %d: services = %v, want %v", i, ts.services, tc.services)
+		}
+	}
+}
+
+func TestParseTTL(t *testing.T) {
+	c := caddy.NewTestController("dns", "tsnames example.com {\n ttl 30\n cname_ttl 300\n negative_ttl 5\n changed_ttl 10 5m\n}")
+	ts, err := parse(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.ttl != 30 || ts.cnameTTL != 300 || ts.negativeTTL != 5 {
+		t.Errorf("TTLs = %d/%d/%d, want 30/300/5", ts.ttl, ts.cnameTTL, ts.negativeTTL)
+	}
+	if ts.changedTTL != 10 || ts.changedWindow != 5*time.Minute {
+		t.Errorf("changed TTL = %d %s, want 10 5m", ts.changedTTL, ts.changedWindow)
+	}
+
+	// Without ttl directives everything uses the default.
+	ts, err = parse(caddy.NewTestController("dns", "tsnames example.com"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.ttl != defaultTTL || ts.cnameTTL != defaultTTL || ts.negativeTTL != defaultTTL || ts.changedWindow != 0 {
+		t.Errorf("default TTLs = %d/%d/%d %s", ts.ttl, ts.cnameTTL, ts.negativeTTL, ts.changedWindow)
+	}
+}
+
+func TestParseZones(t *testing.T) {
+	c := caddy.NewTestController("dns", "tsnames example.com Example.ORG. {\n magicdns\n}")
+	ts, err := parse(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ts.zone != "example.com" {
+		t.Errorf("zone = %q, want example.com", ts.zone)
+	}
+	if len(ts.zones) != 1 || ts.zones[0] != "example.org" {
+		t.Errorf("zones = %v, want [example.org]", ts.zones)
+	}
+	if !ts.magicDNS {
+		t.Error("magicdns not set")
+	}
+
+	if _, err := parse(caddy.NewTestController("dns", "tsnames example.com {\n magicdns yes\n}")); err == nil {
+		t.Error("expected error for magicdns with arguments")
+	}
+}
+
+func TestParseOverride(t *testing.T) {
+	tests := []struct {
+		args      []string
+		shouldErr bool
+		name      string
+		typ       string
+		value     string
+	}{
+		{args: []string{"nas", "A", "10.0.0.5"}, name: "nas", typ: "A", value: "10.0.0.5"},
+		{args: []string{"NAS.Example.com.", "aaaa", "2001:db8::5"}, name: "nas", typ: "AAAA", value: "2001:db8::5"},
+		{args: []string{"www", "CNAME", "Web.LAN"}, name: "www", typ: "CNAME", value: "web.lan."},
+		// Error cases.
+		{args: []string{"nas.example.org.", "A", "10.0.0.5"}, shouldErr: true},
+		{args: []string{"nas", "A", "2001:db8::5"}, shouldErr: true},
+		{args: []string{"nas", "AAAA", "10.0.0.5"}, shouldErr: true},
+		{args: []string{"nas", "A", "nas.lan"}, shouldErr: true},
+		{args: []string{"nas", "MX", "10 mail.lan."}, shouldErr: true},
+	}
+
+	for i, tc := range tests {
+		name, typ, value, err := parseOverride("example.com", tc.args)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("test %d: expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if name != tc.name || typ != tc.typ || value != tc.value {
+			t.Errorf("test %d: got %s %s %s, want %s %s %s", i, name, typ, value, tc.name, tc.typ, tc.value)
+		}
+	}
+
+	c := caddy.NewTestController("dns", "tsnames example.com {\n override nas A 10.0.0.5\n override nas A 10.0.0.6\n}")
+	ts, err := parse(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := ts.overrides["nas"]["A"]; len(got) != 2 {
+		t.Errorf("overrides for nas = %v, want two addresses", got)
+	}
+	if _, err := parse(caddy.NewTestController("dns", "tsnames example.com {\n override nas A\n}")); err == nil {
+		t.Error("expected error for override without value")
+	}
+}
+
+func TestParseOmit(t *testing.T) {
+	c := caddy.NewTestController("dns", "tsnames example.com {\n omit offline\n omit expired\n omit unseen 24h\n prefer_online\n}")
+	ts, err := parse(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !ts.omitOffline || !ts.omitExpired || ts.omitUnseen != 24*time.Hour || !ts.preferOnline {
+		t.Errorf("omit options = %v %v %s %v", ts.omitOffline, ts.omitExpired, ts.omitUnseen, ts.preferOnline)
+	}
+}
@@ -0,0 +1,100 @@
+package tailscale
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultStaleTTL is the TTL of answers served from the snapshot when none is given.
+const defaultStaleTTL = 10
+
+// snapshot is the on-disk form of the entries, written after netmap updates
+// and loaded at startup so names are served before the first netmap arrives.
+type snapshot struct {
+	Entries map[string]map[string][]string `json:"entries"`
+	Reverse map[netip.Addr][]string        `json:"reverse,omitempty"`
+	Self    string                         `json:"self,omitempty"`
+}
+
+// loadSnapshot fills the entries from the snapshot file. They are served as
+// stale until a live netmap replaces them. A missing file is not an error.
+func (t *Tailscale) loadSnapshot() error {
+	b, err := os.ReadFile(t.snapshotFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Infof("No snapshot in %s yet", t.snapshotFile)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	if s.Entries == nil {
+		return errors.New("snapshot has no entries")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.entries != nil {
+		// A live netmap was faster.
+		return nil
+	}
+	t.entries = s.Entries
+	t.reverse = s.Reverse
+	t.self = s.Self
+	t.serial = nextSerial(t.serial, time.Now())
+	t.stale = true
+	log.Infof("Loaded %d entries from snapshot %s, serving them as stale until the netmap arrives", len(s.Entries), t.snapshotFile)
+	return nil
+}
+
+// saveSnapshot atomically replaces the snapshot file with s.
+func (t *Tailscale) saveSnapshot(s snapshot) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(t.snapshotFile), filepath.Base(t.snapshotFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), t.snapshotFile)
+}
+
+// markStale lowers the TTLs of a response built from the snapshot and, if
+// enabled and the client speaks EDNS0, flags it with the Stale Answer EDE.
+func (t *Tailscale) markStale(r, msg *dns.Msg) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			rr.Header().Ttl = min(rr.Header().Ttl, t.staleTTL)
+		}
+	}
+
+	if !t.staleEDE {
+		return
+	}
+	if o := r.IsEdns0(); o != nil {
+		msg.SetEdns0(o.UDPSize(), o.Do())
+		msg.IsEdns0().Option = append(msg.IsEdns0().Option, &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer})
+	}
+}
@@ -0,0 +1,113 @@
+package tailscale
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/miekg/dns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestSnapshot(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "tsnames.json")
+
+	ts := newTS()
+	ts.snapshotFile = file
+	if err := ts.saveSnapshot(snapshot{Entries: ts.entries, Reverse: ts.reverse, Self: "test1"}); err != nil {
+		t.Fatalf("unable to save snapshot: %v", err)
+	}
+
+	restored := &Tailscale{zone: "example.com", snapshotFile: file}
+	if restored.Ready() {
+		t.Fatal("expected not ready before loading the snapshot")
+	}
+	if err := restored.loadSnapshot(); err != nil {
+		t.Fatalf("unable to load snapshot: %v", err)
+	}
+	if !restored.Ready() || !restored.stale {
+		t.Fatal("expected ready and stale after loading the snapshot")
+	}
+	if diff := cmp.Diff(ts.entries, restored.entries); diff != "" {
+		t.Errorf("entries mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(ts.reverse, restored.reverse); diff != "" {
+		t.Errorf("reverse mismatch (-want +got):\n%s", diff)
+	}
+	testEquals(t, "self", "test1", restored.self)
+	if restored.serial == 0 {
+		t.Error("expected a serial after loading the snapshot")
+	}
+}
+
+func TestLoadSnapshotErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	// A missing snapshot is expected on the first start.
+	ts := &Tailscale{snapshotFile: filepath.Join(dir, "missing.json")}
+	if err := ts.loadSnapshot(); err != nil {
+		t.Errorf("expected no error for a missing snapshot, got %v", err)
+	}
+	if ts.Ready() {
+		t.Error("expected not ready without a snapshot")
+	}
+
+	for _, content := range []string{"{", "{}"} {
+		file := filepath.Join(dir, "bad.json")
+		if err := os.WriteFile(file, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		ts := &Tailscale{snapshotFile: file}
+		if err := ts.loadSnapshot(); err == nil {
+			t.Errorf("expected an error for snapshot %q", content)
+		}
+	}
+}
+
+func TestServeDNSStale(t *testing.T) {
+	ts := newTS()
+	ts.ttl = 300
+	ts.staleTTL = 10
+	ts.staleEDE = true
+	ts.stale = true
+
+	var msg dns.Msg
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	w := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := ts.ServeDNS(context.Background(), w, &msg); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	testEquals(t, "TTL", uint32(10), w.Msg.Answer[0].Header().Ttl)
+	opt := w.Msg.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("expected one EDNS0 option, got %v", opt)
+	}
+	testEquals(t, "EDE", dns.ExtendedErrorCodeStaleAnswer, opt.Option[0].(*dns.EDNS0_EDE).InfoCode)
+
+	// Clients without EDNS0 get no OPT record.
+	msg = dns.Msg{}
+	msg.SetQuestion("test1.example.com.", dns.TypeA)
+	w = dnstest.NewRecorder(&test.ResponseWriter{})
+	ts.ServeDNS(context.Background(), w, &msg)
+	if w.Msg.IsEdns0() != nil {
+		t.Error("expected no OPT record without EDNS0 in the query")
+	}
+
+	// A live netmap ends the stale period and refreshes the snapshot.
+	ts.snapshotFile = filepath.Join(t.TempDir(), "tsnames.json")
+	ts.zone = "stale.example"
+	ts.processNetMap(&netmap.NetworkMap{SelfNode: (&tailcfg.Node{ComputedName: "self"}).View()})
+	if ts.stale {
+		t.Error("expected the netmap to clear the stale flag")
+	}
+	if _, err := os.Stat(ts.snapshotFile); err != nil {
+		t.Errorf("expected the snapshot to be written: %v", err)
+	}
+}
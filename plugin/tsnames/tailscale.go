@@ -1,114 +1,154 @@
 package tailscale
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
 	"github.com/coredns/coredns/plugin/pkg/fall"
 	ts "github.com/coredns/coredns/plugin/tailscale"
+	"github.com/coredns/coredns/plugin/transfer"
 
-	"tailscale.com/ipn"
+	"github.com/miekg/dns"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
 )
 
+// lastNetMap is the latest netmap of any instance. A reload starts instances
+// that only get the netmap from their own watcher a while later, until then
+// they serve this one instead of answering NXDOMAIN.
+var lastNetMap atomic.Pointer[netmap.NetworkMap]
+
 type Tailscale struct {
 	next plugin.Handler
+	// zone is the primary zone, names in the entries are qualified with it.
 	zone string
-	fall fall.F
+	// zones are further zones answering identically to the primary zone.
+	zones []string
+	fall  fall.F
+
+	// magicDNS adds the tailnet's MagicDNS domain to the served zones.
+	magicDNS bool
+	// routes enables records describing subnet and exit routes.
+	routes bool
+
+	// omitOffline, omitExpired and omitUnseen leave out nodes that are offline,
+	// have an expired key or were last seen longer than omitUnseen ago.
+	omitOffline bool
+	omitExpired bool
+	omitUnseen  time.Duration
+	// preferOnline drops CNAME targets of offline nodes, unless all are offline.
+	preferOnline bool
+
+	// snapshotFile persists the entries across restarts, empty disables it.
+	// Answers from the snapshot get at most staleTTL and, with staleEDE, the
+	// Stale Answer extended error.
+	snapshotFile string
+	staleTTL     uint32
+	staleEDE     bool
+
+	// srvPrefix enables SRV records from tags of the form tag:<srvPrefix><service>-<proto>-<port>.
+	srvPrefix string
+	// txt enables TXT records describing each node.
+	txt bool
+	// wildcard answers any name below <node>.<zone> with the node's records.
+	wildcard bool
+	// shared is the naming scheme for nodes shared into the tailnet, empty
+	// when they are left out.
+	shared       string
+	sharedPrefix string
+	// services adds the tailnet's Tailscale Services as <service>.<zone>.
+	services bool
+	// overrides are static records from the Corefile, keyed like entries.
+	// They replace netmap entries of the same name.
+	overrides map[string]map[string][]string
+
+	// TTLs of positive answers, CNAMEs and negative answers.
+	ttl         uint32
+	cnameTTL    uint32
+	negativeTTL uint32
+	// changedTTL replaces longer TTLs for names whose addresses changed
+	// within changedWindow, zero window disables it.
+	changedTTL    uint32
+	changedWindow time.Duration
 
 	mu      sync.RWMutex
 	entries map[string]map[string][]string
+	reverse map[netip.Addr][]string
+	// stale is set while the entries come from the snapshot.
+	stale bool
+	// offline holds the names of nodes the netmap reports as offline.
+	offline map[string]bool
+	// routeTable holds the addresses and routes of all nodes when routes is set.
+	routeTable []nodeRoute
+	// changed holds when the addresses of a name last changed, for names that
+	// changed within changedWindow.
+	changed map[string]time.Time
+	// magicDNSZone is the tailnet's MagicDNS domain, when magicDNS is set.
+	magicDNSZone string
+	// self is this node's name in the zone, used as the NS of the zone.
+	self string
+	// serial is the SOA serial, bumped on every netmap update.
+	serial uint32
+	// xfer is the transfer plugin of the server block, notified when the
+	// zone changes. Nil when zone transfers are not configured.
+	xfer *transfer.Transfer
 }
 
 // Name implements the Handler interface.
-func (t *Tailscale) Name() string { return "tailscale" }
-
-// start connects the Tailscale plugin to a tailscale daemon and populates DNS entries for nodes in the tailnet.
-// DNS entries are automatically kept up to date with any node changes.
-//
-// If t.authkey is non-empty, this function uses that key to connect to the Tailnet using a tsnet server
-// instead of connecting to the local tailscaled instance.
-func (t *Tailscale) start() error {
+func (t *Tailscale) Name() string { return "tsnames" }
+
+// load populates the DNS entries from the netmap the previous instance last processed, or else from the
+// snapshot. watchIPNBus keeps them up to date afterwards.
+func (t *Tailscale) load() error {
 	if ts.GetGlobalTailscale() == nil {
 		return fmt.Errorf("tailscale not initialized, can't use 'tsnames' plugin")
 	}
 
-	go t.watchIPNBus()
+	t.resume()
+	if t.snapshotFile != "" {
+		if err := t.loadSnapshot(); err != nil {
+			log.Warningf("Unable to load snapshot %s: %v", t.snapshotFile, err)
+		}
+	}
 	return nil
 }
 
-// busBackoffMin/busBackoffMax bound the reconnect backoff for the IPN bus
-// watcher. tailscaled can accept a watch connection and then immediately drop
-// the stream (e.g. while it recomputes the netmap around a node change). An
-// unthrottled reconnect loop in that window spins a CPU core and allocates
-// connection/decode garbage faster than the GC can reclaim it; under a tight
-// cgroup memory limit the runtime then gets OOM-killed even though the live
-// heap stays small.
-const (
-	busBackoffMin = 1 * time.Second
-	busBackoffMax = 1 * time.Minute
-)
-
-// nextBusBackoff doubles the current backoff, saturating at busBackoffMax.
-func nextBusBackoff(cur time.Duration) time.Duration {
-	next := cur * 2
-	if next > busBackoffMax {
-		return busBackoffMax
+// resume fills the entries from the netmap the previous instance last
+// processed, if any. The snapshot is only loaded when there is none.
+func (t *Tailscale) resume() {
+	if nm := lastNetMap.Load(); nm != nil {
+		t.processNetMap(nm)
 	}
-	return next
 }
 
 // watchIPNBus watches the Tailscale IPN Bus and updates DNS entries for any netmap update.
-// This function does not return. If it is unable to read from the IPN Bus, it will continue to retry.
-func (t *Tailscale) watchIPNBus() {
-	backoff := busBackoffMin
-	for {
-		watcher, err := ts.GetGlobalTailscale().Client.WatchIPNBus(context.Background(), ipn.NotifyInitialNetMap)
-		if err != nil {
-			log.Warningf("unable to connect to Tailscale event bus: %v; retrying in %s", err, backoff)
-			busReconnectsTotal.WithLabelValues(t.zone).Inc()
-			time.Sleep(backoff)
-			backoff = nextBusBackoff(backoff)
-			continue
+// This function returns when ctx is done. If it is unable to read from the IPN Bus, it will continue to retry.
+func (t *Tailscale) watchIPNBus(ctx context.Context) {
+	ts.GetGlobalTailscale().WatchNetMap(ctx, t.processNetMap, func() {
+		t.mu.RLock()
+		zones := t.servedZones()
+		t.mu.RUnlock()
+		for _, zone := range zones {
+			busReconnectsTotal.WithLabelValues(zone).Inc()
 		}
-
-		connectedAt := time.Now()
-		for {
-			n, err := watcher.Next()
-			if err != nil {
-				// Stream errored mid-flight. Close and reconnect — but the
-				// reconnect MUST back off (see busBackoffMin/Max): tailscaled
-				// can drop the stream the instant after accepting it, and an
-				// unthrottled retry here spins the CPU and exhausts memory.
-				// Don't `defer` the Close — the outer loop never exits, so
-				// deferred closes would pile up forever.
-				watcher.Close()
-				break
-			}
-			t.processNetMap(n.NetMap)
-		}
-
-		// A watcher that stayed up comfortably longer than the cap is healthy,
-		// so reset the backoff; rapid flapping keeps escalating it toward the cap.
-		if time.Since(connectedAt) > busBackoffMax {
-			backoff = busBackoffMin
-		}
-		log.Warningf("Tailscale event bus disconnected after %s; reconnecting in %s", time.Since(connectedAt).Round(time.Millisecond), backoff)
-		busReconnectsTotal.WithLabelValues(t.zone).Inc()
-		time.Sleep(backoff)
-		backoff = nextBusBackoff(backoff)
-	}
+	})
 }
 
 func (t *Tailscale) processNetMap(nm *netmap.NetworkMap) {
 	if nm == nil {
 		return
 	}
+	lastNetMap.Store(nm)
 
 	log.Debugf("Self tags: %+v", nm.SelfNode.Tags().AsSlice())
 	nodes := make([]tailcfg.NodeView, 0, 1+len(nm.Peers))
@@ -116,34 +156,46 @@ func (t *Tailscale) processNetMap(nm *netmap.NetworkMap) {
 	nodes = append(nodes, nm.Peers...)
 
 	entries := map[string]map[string][]string{}
-	for _, node := range nodes {
+	reverse := map[netip.Addr][]string{}
+	aliases := map[string]map[string][]string{}
+	offline := map[string]bool{}
+	var routes []nodeRoute
+	var shared []tailcfg.NodeView
+	now := time.Now()
+	for i, node := range nodes {
 		if node.IsWireGuardOnly() {
 			// IsWireGuardOnly identifies a node as a Mullvad exit node.
 			continue
 		}
+		// The node CoreDNS runs on is always served, it is up by definition.
+		if reason := t.omitReason(node, now); reason != "" && i > 0 {
+			log.Debugf("Omitting %s, %s", node.Name(), reason)
+			continue
+		}
 		if !node.Sharer().IsZero() {
-			// Skip shared nodes, since they don't necessarily have unique hostnames within this tailnet.
-			// TODO: possibly make it configurable to include shared nodes and figure out what hostname to use.
+			// Shared nodes don't necessarily have unique hostnames within this tailnet,
+			// they are named after all nodes of the tailnet are in place.
+			if t.shared != "" {
+				shared = append(shared, node)
+			}
 			continue
 		}
 
-		hostname := node.ComputedName()
+		// Queries are matched case-insensitively against lowercase keys.
+		hostname := strings.ToLower(node.ComputedName())
 		entry, ok := entries[hostname]
 		if !ok {
 			entry = map[string][]string{}
 		}
-
-		// Currently entry["A"/"AAAA"] will have max one element
-		for _, pfx := range node.Addresses().AsSlice() {
-			addr := pfx.Addr()
-			if addr.Is4() {
-				entry["A"] = append(entry["A"], addr.String())
-			} else if addr.Is6() {
-				entry["AAAA"] = append(entry["AAAA"], addr.String())
-			}
+		t.addNode(entry, reverse, node, hostname)
+		if isOffline(node) {
+			offline[hostname] = true
+		}
+		if t.routes {
+			routes = t.addRoutes(entries, routes, node, hostname)
 		}
 
-		// Process Tags looking for cname- prefixed ones
+		// Process Tags looking for cname-, alias- and SRV prefixed ones
 		if node.Tags().Len() > 0 {
 			for _, raw := range node.Tags().AsSlice() {
 				if tag, ok := strings.CutPrefix(raw, "tag:cname-"); ok {
@@ -151,6 +203,25 @@ func (t *Tailscale) processNetMap(nm *netmap.NetworkMap) {
 						entries[tag] = map[string][]string{}
 					}
 					entries[tag]["CNAME"] = append(entries[tag]["CNAME"], fmt.Sprintf("%s.%s.", hostname, t.zone))
+				} else if tag, ok := strings.CutPrefix(raw, "tag:alias-"); ok {
+					if _, ok := aliases[tag]; !ok {
+						aliases[tag] = map[string][]string{}
+					}
+					for _, typ := range []string{"A", "AAAA"} {
+						if addrs, ok := entry[typ]; ok {
+							aliases[tag][typ] = append(aliases[tag][typ], addrs...)
+						}
+					}
+				} else if tag, ok := strings.CutPrefix(raw, "tag:"+t.srvPrefix); ok && t.srvPrefix != "" {
+					name, srv, ok := parseSRVTag(tag, fmt.Sprintf("%s.%s.", hostname, t.zone))
+					if !ok {
+						log.Warningf("Ignoring malformed SRV tag %q on %s, expected %s<service>-<proto>-<port>", raw, hostname, t.srvPrefix)
+						continue
+					}
+					if _, ok := entries[name]; !ok {
+						entries[name] = map[string][]string{}
+					}
+					entries[name]["SRV"] = append(entries[name]["SRV"], srv)
 				}
 			}
 		}
@@ -158,11 +229,269 @@ func (t *Tailscale) processNetMap(nm *netmap.NetworkMap) {
 		entries[hostname] = entry
 	}
 
+	// Aliases are added once all nodes are in place, so a node always keeps its own name.
+	for name, alias := range aliases {
+		if _, ok := entries[name]; ok {
+			log.Warningf("Ignoring alias %s.%s, the name is already taken", name, t.zone)
+			continue
+		}
+		entries[name] = alias
+	}
+
+	// Names of the own tailnet always win. Among shared nodes the one with the
+	// lowest node ID wins, so collisions resolve the same way on every update.
+	slices.SortFunc(shared, func(a, b tailcfg.NodeView) int { return cmp.Compare(a.ID(), b.ID()) })
+	sharedEntries := 0
+	for _, node := range shared {
+		name, ok := t.sharedName(node)
+		if !ok {
+			log.Warningf("Skipping shared node %s, unable to name it", node.Name())
+			continue
+		}
+		if _, ok := entries[name]; ok {
+			log.Warningf("Skipping shared node %s, the name %s.%s is already taken", node.Name(), name, t.zone)
+			continue
+		}
+
+		entry := map[string][]string{}
+		t.addNode(entry, reverse, node, name)
+		if isOffline(node) {
+			offline[name] = true
+		}
+		if t.routes {
+			routes = t.addRoutes(entries, routes, node, name)
+		}
+		entries[name] = entry
+		sharedEntries++
+	}
+
+	// Services come last, nodes keep their names.
+	serviceEntries := 0
+	if t.services {
+		serviceEntries = t.addServices(entries, reverse, tailnetServices(nm))
+	}
+
+	// Overrides from the Corefile win over everything learned from the netmap.
+	for name, override := range t.overrides {
+		if _, ok := entries[name]; ok {
+			log.Debugf("Override replaces %s.%s from the netmap", name, t.zone)
+		}
+		entries[name] = maps.Clone(override)
+	}
+
 	t.mu.Lock()
+	save := t.entries == nil || t.stale
+	t.stale = false
+	modified := t.entries != nil && !maps.EqualFunc(entries, t.entries, sameRecords)
+	t.changed = t.trackChanges(entries, time.Now())
 	t.entries = entries
+	t.reverse = reverse
+	t.routeTable = routes
+	t.offline = offline
+	self := strings.ToLower(nm.SelfNode.ComputedName())
+	t.self = self
+	if t.magicDNS {
+		t.magicDNSZone = strings.ToLower(nm.MagicDNSSuffix())
+	}
+	zones := t.servedZones()
+	t.serial = nextSerial(t.serial, time.Now())
+	xfer := t.xfer
 	t.mu.Unlock()
 
-	entriesGauge.WithLabelValues(t.zone).Set(float64(len(entries)))
-	netmapUpdatesTotal.WithLabelValues(t.zone).Inc()
-	log.Debugf("updated %d Tailscale entries", len(entries))
+	// Netmap updates are frequent, only tell secondaries when the records changed.
+	if modified && xfer != nil {
+		go notify(xfer, zones)
+	}
+	if t.snapshotFile != "" && (modified || save) {
+		if err := t.saveSnapshot(snapshot{Entries: entries, Reverse: reverse, Self: self}); err != nil {
+			log.Warningf("Unable to save snapshot %s: %v", t.snapshotFile, err)
+		}
+	}
+
+	for _, zone := range zones {
+		entriesGauge.WithLabelValues(zone).Set(float64(len(entries)))
+		sourceEntriesGauge.WithLabelValues(zone, "tailnet").Set(float64(len(entries) - sharedEntries - serviceEntries))
+		sourceEntriesGauge.WithLabelValues(zone, "shared").Set(float64(sharedEntries))
+		sourceEntriesGauge.WithLabelValues(zone, "service").Set(float64(serviceEntries))
+		netmapUpdatesTotal.WithLabelValues(zone).Inc()
+	}
+	log.Debugf("updated %d Tailscale entries, %d of them shared and %d services", len(entries), sharedEntries, serviceEntries)
+}
+
+// trackChanges returns the change times of the names in entries, compared to
+// the entries currently served. Names that are new or whose addresses or CNAME
+// targets differ are stamped with now. The initial netmap changes nothing.
+func (t *Tailscale) trackChanges(entries map[string]map[string][]string, now time.Time) map[string]time.Time {
+	changed := map[string]time.Time{}
+	if t.changedWindow == 0 || t.entries == nil {
+		return changed
+	}
+
+	for name, entry := range entries {
+		old, ok := t.entries[name]
+		if !ok || !slices.Equal(entry["A"], old["A"]) || !slices.Equal(entry["AAAA"], old["AAAA"]) || !slices.Equal(entry["CNAME"], old["CNAME"]) {
+			changed[name] = now
+			continue
+		}
+		if at, ok := t.changed[name]; ok && now.Sub(at) < t.changedWindow {
+			changed[name] = at
+		}
+	}
+	return changed
+}
+
+// omitReason returns why the node is left out according to the omit options,
+// or the empty string if it is served.
+func (t *Tailscale) omitReason(node tailcfg.NodeView, now time.Time) string {
+	if t.omitOffline && isOffline(node) {
+		return "node is offline"
+	}
+	if t.omitExpired {
+		if expiry := node.KeyExpiry(); node.Expired() || (!expiry.IsZero() && expiry.Before(now)) {
+			return "node key expired"
+		}
+	}
+	if t.omitUnseen > 0 {
+		online, _ := node.Online().GetOk()
+		if lastSeen, ok := node.LastSeen().GetOk(); ok && !online && now.Sub(lastSeen) > t.omitUnseen {
+			return fmt.Sprintf("node last seen %s ago", now.Sub(lastSeen).Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// isOffline reports whether the netmap knows the node to be offline. Nodes
+// without online state are considered online.
+func isOffline(node tailcfg.NodeView) bool {
+	online, ok := node.Online().GetOk()
+	return ok && !online
+}
+
+// addNode fills entry with the node's address and TXT records and indexes its
+// addresses for PTR lookups under name.
+func (t *Tailscale) addNode(entry map[string][]string, reverse map[netip.Addr][]string, node tailcfg.NodeView, name string) {
+	// Currently entry["A"/"AAAA"] will have max one element
+	for _, pfx := range node.Addresses().AsSlice() {
+		addr := pfx.Addr()
+		if addr.Is4() {
+			entry["A"] = append(entry["A"], addr.String())
+		} else if addr.Is6() {
+			entry["AAAA"] = append(entry["AAAA"], addr.String())
+		}
+		if isTailnetAddr(addr) {
+			reverse[addr] = append(reverse[addr], fmt.Sprintf("%s.%s.", name, t.zone))
+		}
+	}
+
+	if t.txt {
+		if txt := nodeTXT(node); len(txt) > 0 {
+			entry["TXT"] = txt
+		}
+	}
+}
+
+// Naming schemes for nodes shared into the tailnet.
+const (
+	// sharedSubdomain names a shared node <host>.<tailnet>, after the tailnet it
+	// was shared from.
+	sharedSubdomain = "subdomain"
+	// sharedPrefix names a shared node <prefix><host>.
+	sharedPrefix = "prefix"
+)
+
+// sharedName returns the name of a shared node relative to the zone.
+func (t *Tailscale) sharedName(node tailcfg.NodeView) (string, bool) {
+	host := strings.ToLower(node.ComputedName())
+	if host == "" {
+		return "", false
+	}
+
+	switch t.shared {
+	case sharedSubdomain:
+		// Name is the node's FQDN in the sharer's tailnet, e.g. host.tail1234.ts.net.
+		labels := dns.SplitDomainName(node.Name())
+		if len(labels) < 2 {
+			return "", false
+		}
+		return host + "." + strings.ToLower(labels[1]), true
+	case sharedPrefix:
+		return t.sharedPrefix + host, true
+	}
+	return "", false
+}
+
+// parseSRVTag turns the <service>-<proto>-<port> part of a SRV tag into the
+// owner name relative to the zone and the SRV data pointing at target.
+// Services may contain dashes, so the tag is split from the end.
+func parseSRVTag(tag, target string) (name, srv string, ok bool) {
+	parts := strings.Split(tag, "-")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+
+	port, err := strconv.ParseUint(parts[len(parts)-1], 10, 16)
+	if err != nil || port == 0 {
+		return "", "", false
+	}
+	proto := parts[len(parts)-2]
+	service := strings.Join(parts[:len(parts)-2], "-")
+	if proto == "" || service == "" {
+		return "", "", false
+	}
+
+	return fmt.Sprintf("_%s._%s", service, proto), fmt.Sprintf("0 0 %d %s", port, target), true
+}
+
+// volatileTXT are the TXT keys that change with the node's presence rather than
+// its records, see sameRecords.
+var volatileTXT = []string{"online=", "lastseen="}
+
+// sameRecords reports whether two entries hold the same records, ignoring the
+// volatile TXT strings. Presence changes on almost every netmap update, they
+// must not count as zone changes that NOTIFY secondaries or rewrite snapshots.
+func sameRecords(a, b map[string][]string) bool {
+	return maps.EqualFunc(a, b, func(x, y []string) bool {
+		return slices.Equal(stableTXT(x), stableTXT(y))
+	})
+}
+
+// stableTXT returns txt without the volatile strings. Values of other types
+// are returned as they are.
+func stableTXT(txt []string) []string {
+	return slices.DeleteFunc(slices.Clone(txt), func(s string) bool {
+		return slices.ContainsFunc(volatileTXT, func(key string) bool { return strings.HasPrefix(s, key) })
+	})
+}
+
+// nodeTXT describes the node as key=value strings for its TXT record.
+func nodeTXT(node tailcfg.NodeView) []string {
+	var txt []string
+	if hi := node.Hostinfo(); hi.Valid() {
+		if os := hi.OS(); os != "" {
+			txt = append(txt, "os="+os)
+		}
+		if version := hi.IPNVersion(); version != "" {
+			txt = append(txt, "version="+version)
+		}
+	}
+	if node.Tags().Len() > 0 {
+		txt = append(txt, "tags="+strings.Join(node.Tags().AsSlice(), ","))
+	}
+	if online, ok := node.Online().GetOk(); ok {
+		txt = append(txt, "online="+strconv.FormatBool(online))
+	}
+	if lastSeen, ok := node.LastSeen().GetOk(); ok {
+		txt = append(txt, "lastseen="+lastSeen.UTC().Format(time.RFC3339))
+	}
+	return txt
+}
+
+// nextSerial returns a SOA serial for a zone changed at now. It follows the
+// clock, but always increases, even for several updates within a second.
+func nextSerial(serial uint32, now time.Time) uint32 {
+	next := uint32(now.Unix())
+	if next <= serial {
+		next = serial + 1
+	}
+	return next
 }
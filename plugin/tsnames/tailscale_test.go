@@ -2,6 +2,7 @@ package tailscale
 
 import (
 	"net/netip"
+	"slices"
 	"testing"
 	"time"
 
@@ -11,31 +12,6 @@ import (
 	"tailscale.com/types/netmap"
 )
 
-func TestNextBusBackoff(t *testing.T) {
-	// Starting from the minimum, the backoff doubles each step and then
-	// saturates at the cap — it must never exceed busBackoffMax, otherwise a
-	// reconnect storm would not be throttled.
-	cur := busBackoffMin
-	want := []time.Duration{
-		2 * time.Second,
-		4 * time.Second,
-		8 * time.Second,
-		16 * time.Second,
-		32 * time.Second,
-		busBackoffMax, // 64s would exceed the 60s cap
-		busBackoffMax,
-	}
-	for i, w := range want {
-		cur = nextBusBackoff(cur)
-		if cur != w {
-			t.Fatalf("step %d: nextBusBackoff = %s, want %s", i, cur, w)
-		}
-	}
-	if got := nextBusBackoff(busBackoffMax); got != busBackoffMax {
-		t.Errorf("nextBusBackoff(max) = %s, want %s (must stay capped)", got, busBackoffMax)
-	}
-}
-
 func TestProcessNetMap(t *testing.T) {
 	ts := &Tailscale{zone: "example.com"}
 
@@ -100,6 +76,14 @@ func TestProcessNetMap(t *testing.T) {
 	if !cmp.Equal(ts.entries, want) {
 		t.Errorf("ts.entries = %v, want %v", ts.entries, want)
 	}
+	// Only addresses from the tailnet ranges are indexed for PTR lookups.
+	wantReverse := map[netip.Addr][]string{
+		netip.MustParseAddr("fd7a:115c:a1e0::1"): {"self.example.com."},
+		netip.MustParseAddr("fd7a:115c:a1e0::2"): {"peer.example.com."},
+	}
+	if !cmp.Equal(ts.reverse, wantReverse, cmp.Comparer(func(a, b netip.Addr) bool { return a == b })) {
+		t.Errorf("ts.reverse = %v, want %v", ts.reverse, wantReverse)
+	}
 	if got := testutil.ToFloat64(entriesGauge.WithLabelValues("example.com")); got != 3 {
 		t.Errorf("entries = %v, want 3", got)
 	}
@@ -128,3 +112,357 @@ func TestProcessNetMap(t *testing.T) {
 		t.Errorf("netmapUpdatesTotal = %v, want 2", got)
 	}
 }
+
+func TestProcessNetMapShared(t *testing.T) {
+	node := func(id tailcfg.NodeID, name, fqdn, addr string, sharer tailcfg.UserID) tailcfg.NodeView {
+		return (&tailcfg.Node{
+			ID:           id,
+			ComputedName: name,
+			Name:         fqdn,
+			Sharer:       sharer,
+			Addresses:    []netip.Prefix{netip.MustParsePrefix(addr)},
+		}).View()
+	}
+
+	nm := &netmap.NetworkMap{
+		SelfNode: node(1, "self", "self.tailnet.ts.net.", "100.64.0.1/32", 0),
+		Peers: []tailcfg.NodeView{
+			node(2, "ext-db", "ext-db.tailnet.ts.net.", "100.64.0.2/32", 0),
+			// Two shared nodes with the same name, the lower ID wins regardless of order.
+			node(9, "web", "web.other.ts.net.", "100.64.0.9/32", 42),
+			node(8, "web", "web.other.ts.net.", "100.64.0.8/32", 42),
+			node(7, "db", "db.third.ts.net.", "100.64.0.7/32", 43),
+		},
+	}
+
+	tests := []struct {
+		shared, prefix string
+		want           map[string][]string
+		wantShared     float64
+	}{
+		{
+			shared: sharedSubdomain,
+			want: map[string][]string{
+				"self":      {"100.64.0.1"},
+				"ext-db":    {"100.64.0.2"},
+				"web.other": {"100.64.0.8"},
+				"db.third":  {"100.64.0.7"},
+			},
+			wantShared: 2,
+		},
+		{
+			// ext-db is taken by a node of the tailnet.
+			shared: sharedPrefix, prefix: "ext-",
+			want: map[string][]string{
+				"self":    {"100.64.0.1"},
+				"ext-db":  {"100.64.0.2"},
+				"ext-web": {"100.64.0.8"},
+			},
+			wantShared: 1,
+		},
+		{
+			want: map[string][]string{
+				"self":   {"100.64.0.1"},
+				"ext-db": {"100.64.0.2"},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		ts := &Tailscale{zone: "shared.example", shared: tc.shared, sharedPrefix: tc.prefix}
+		ts.processNetMap(nm)
+
+		got := map[string][]string{}
+		for name, entry := range ts.entries {
+			got[name] = entry["A"]
+		}
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("shared %q: entries mismatch (-want +got):\n%s", tc.shared, diff)
+		}
+		if got := testutil.ToFloat64(sourceEntriesGauge.WithLabelValues("shared.example", "shared")); got != tc.wantShared {
+			t.Errorf("shared %q: shared entries = %v, want %v", tc.shared, got, tc.wantShared)
+		}
+	}
+}
+
+func TestParseSRVTag(t *testing.T) {
+	tests := []struct {
+		tag      string
+		wantName string
+		wantSRV  string
+		wantOK   bool
+	}{
+		{"http-tcp-8080", "_http._tcp", "0 0 8080 host.example.com.", true},
+		{"my-app-udp-53", "_my-app._udp", "0 0 53 host.example.com.", true},
+		{"http-tcp", "", "", false},
+		{"http-tcp-http", "", "", false},
+		{"http-tcp-0", "", "", false},
+		{"http-tcp-70000", "", "", false},
+		{"-tcp-80", "", "", false},
+	}
+
+	for _, tc := range tests {
+		name, srv, ok := parseSRVTag(tc.tag, "host.example.com.")
+		if name != tc.wantName || srv != tc.wantSRV || ok != tc.wantOK {
+			t.Errorf("parseSRVTag(%q) = %q, %q, %v; want %q, %q, %v", tc.tag, name, srv, ok, tc.wantName, tc.wantSRV, tc.wantOK)
+		}
+	}
+}
+
+func TestProcessNetMapSRVAndTXT(t *testing.T) {
+	ts := &Tailscale{zone: "example.com", srvPrefix: "srv-", txt: true}
+
+	lastSeen := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	online := false
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+			Tags:         []string{"tag:srv-http-tcp-8080", "tag:srv-broken"},
+			Hostinfo:     (&tailcfg.Hostinfo{OS: "linux", IPNVersion: "1.80.0"}).View(),
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "peer",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Tags:         []string{"tag:srv-http-tcp-80"},
+				Online:       &online,
+				LastSeen:     &lastSeen,
+			}).View(),
+		},
+	}
+
+	ts.processNetMap(nm)
+
+	wantSRV := []string{"0 0 8080 self.example.com.", "0 0 80 peer.example.com."}
+	if diff := cmp.Diff(wantSRV, ts.entries["_http._tcp"]["SRV"]); diff != "" {
+		t.Errorf("SRV entries mismatch (-want +got):\n%s", diff)
+	}
+
+	wantSelfTXT := []string{"os=linux", "version=1.80.0", "tags=tag:srv-http-tcp-8080,tag:srv-broken"}
+	if diff := cmp.Diff(wantSelfTXT, ts.entries["self"]["TXT"]); diff != "" {
+		t.Errorf("self TXT mismatch (-want +got):\n%s", diff)
+	}
+	wantPeerTXT := []string{"tags=tag:srv-http-tcp-80", "online=false", "lastseen=2024-05-01T12:00:00Z"}
+	if diff := cmp.Diff(wantPeerTXT, ts.entries["peer"]["TXT"]); diff != "" {
+		t.Errorf("peer TXT mismatch (-want +got):\n%s", diff)
+	}
+
+	// Without the options, the tags are not interpreted and no TXT is built.
+	ts = &Tailscale{zone: "example.com"}
+	ts.processNetMap(nm)
+	if _, ok := ts.entries["_http._tcp"]; ok {
+		t.Errorf("SRV entries built without the srv option")
+	}
+	if _, ok := ts.entries["self"]["TXT"]; ok {
+		t.Errorf("TXT entries built without the txt option")
+	}
+}
+
+func TestNextSerial(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	if got := nextSerial(0, now); got != 1700000000 {
+		t.Errorf("nextSerial from 0 = %d, want 1700000000", got)
+	}
+	// A second update within the same second still increases the serial.
+	if got := nextSerial(1700000000, now); got != 1700000001 {
+		t.Errorf("nextSerial within a second = %d, want 1700000001", got)
+	}
+}
+
+func TestTrackChanges(t *testing.T) {
+	ts := &Tailscale{zone: "example.com", changedTTL: 5, changedWindow: time.Minute}
+	now := time.Unix(1700000000, 0)
+
+	// The initial netmap doesn't mark anything as changed.
+	first := map[string]map[string][]string{
+		"laptop": {"A": {"100.64.0.1"}},
+		"server": {"A": {"100.64.0.2"}},
+	}
+	if got := ts.trackChanges(first, now); len(got) != 0 {
+		t.Errorf("initial changes = %v, want none", got)
+	}
+	ts.entries = first
+
+	// The laptop roamed, a desktop joined. TXT-only differences don't count.
+	second := map[string]map[string][]string{
+		"laptop":  {"A": {"100.64.0.9"}},
+		"server":  {"A": {"100.64.0.2"}, "TXT": {"online=true"}},
+		"desktop": {"A": {"100.64.0.3"}},
+	}
+	want := map[string]time.Time{"laptop": now, "desktop": now}
+	ts.changed = ts.trackChanges(second, now)
+	if diff := cmp.Diff(want, ts.changed); diff != "" {
+		t.Errorf("changes mismatch (-want +got):\n%s", diff)
+	}
+	ts.entries = second
+
+	// Unchanged names keep their change time until the window has passed.
+	later := now.Add(30 * time.Second)
+	if diff := cmp.Diff(want, ts.trackChanges(second, later)); diff != "" {
+		t.Errorf("changes within window mismatch (-want +got):\n%s", diff)
+	}
+	if got := ts.trackChanges(second, now.Add(time.Minute)); len(got) != 0 {
+		t.Errorf("changes after window = %v, want none", got)
+	}
+}
+
+func TestProcessNetMapMagicDNS(t *testing.T) {
+	ts := &Tailscale{zone: "magic.example", magicDNS: true}
+	ts.processNetMap(&netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Name:         "self.Tail1234.ts.net.",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32")},
+		}).View(),
+	})
+
+	if ts.magicDNSZone != "tail1234.ts.net" {
+		t.Errorf("magicDNSZone = %q, want tail1234.ts.net", ts.magicDNSZone)
+	}
+	if got := testutil.ToFloat64(sourceEntriesGauge.WithLabelValues("tail1234.ts.net", "tailnet")); got != 1 {
+		t.Errorf("entries of the MagicDNS zone = %v, want 1", got)
+	}
+}
+
+func TestProcessNetMapAliasesAndOverrides(t *testing.T) {
+	ts := &Tailscale{
+		zone: "alias.example",
+		overrides: map[string]map[string][]string{
+			"nas":     {"A": {"192.168.1.5"}},
+			"printer": {"CNAME": {"printer.lan."}},
+		},
+	}
+
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.1/32"), netip.MustParsePrefix("fd7a:115c:a1e0::1/128")},
+			Tags:         []string{"tag:alias-web", "tag:alias-peer"},
+		}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{
+				ComputedName: "peer",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.2/32")},
+				Tags:         []string{"tag:alias-web"},
+			}).View(),
+			(&tailcfg.Node{
+				ComputedName: "nas",
+				Addresses:    []netip.Prefix{netip.MustParsePrefix("100.64.0.3/32")},
+			}).View(),
+		},
+	}
+	ts.processNetMap(nm)
+
+	want := map[string]map[string][]string{
+		"self": {"A": {"100.64.0.1"}, "AAAA": {"fd7a:115c:a1e0::1"}},
+		// alias-peer is ignored, the node keeps its own name.
+		"peer": {"A": {"100.64.0.2"}},
+		// Aliases point directly at all nodes carrying them.
+		"web": {"A": {"100.64.0.1", "100.64.0.2"}, "AAAA": {"fd7a:115c:a1e0::1"}},
+		// Overrides replace the netmap data.
+		"nas":     {"A": {"192.168.1.5"}},
+		"printer": {"CNAME": {"printer.lan."}},
+	}
+	if diff := cmp.Diff(want, ts.entries); diff != "" {
+		t.Errorf("entries mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProcessNetMapOmit(t *testing.T) {
+	now := time.Now()
+	online, offline := true, false
+	longAgo, recently := now.Add(-48*time.Hour), now.Add(-time.Minute)
+
+	nm := &netmap.NetworkMap{
+		// Self is served even though it looks offline.
+		SelfNode: (&tailcfg.Node{ComputedName: "self", Online: &offline}).View(),
+		Peers: []tailcfg.NodeView{
+			(&tailcfg.Node{ComputedName: "up", Online: &online, LastSeen: &longAgo}).View(),
+			(&tailcfg.Node{ComputedName: "down", Online: &offline, LastSeen: &recently}).View(),
+			(&tailcfg.Node{ComputedName: "gone", Online: &offline, LastSeen: &longAgo}).View(),
+			(&tailcfg.Node{ComputedName: "expired", Expired: true}).View(),
+			(&tailcfg.Node{ComputedName: "expiring", KeyExpiry: now.Add(-time.Hour)}).View(),
+			(&tailcfg.Node{ComputedName: "unknown"}).View(),
+		},
+	}
+
+	tests := []struct {
+		ts   *Tailscale
+		want []string
+	}{
+		{&Tailscale{}, []string{"down", "expired", "expiring", "gone", "self", "unknown", "up"}},
+		{&Tailscale{omitOffline: true}, []string{"expired", "expiring", "self", "unknown", "up"}},
+		{&Tailscale{omitExpired: true}, []string{"down", "gone", "self", "unknown", "up"}},
+		{&Tailscale{omitUnseen: 24 * time.Hour}, []string{"down", "expired", "expiring", "self", "unknown", "up"}},
+	}
+
+	for i, tc := range tests {
+		tc.ts.zone = "omit.example"
+		tc.ts.processNetMap(nm)
+
+		var got []string
+		for name := range tc.ts.entries {
+			got = append(got, name)
+		}
+		slices.Sort(got)
+		if diff := cmp.Diff(tc.want, got); diff != "" {
+			t.Errorf("test %d: names mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+
+	ts := &Tailscale{zone: "omit.example"}
+	ts.processNetMap(nm)
+	want := map[string]bool{"self": true, "down": true, "gone": true}
+	if diff := cmp.Diff(want, ts.offline); diff != "" {
+		t.Errorf("offline mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSameRecords(t *testing.T) {
+	a := map[string][]string{"A": {"100.64.0.2"}, "TXT": {"os=linux", "online=true", "lastseen=2024-05-01T12:00:00Z"}}
+	tests := []struct {
+		name string
+		b    map[string][]string
+		want bool
+	}{
+		{"presence changed", map[string][]string{"A": {"100.64.0.2"}, "TXT": {"os=linux", "online=false", "lastseen=2024-05-02T12:00:00Z"}}, true},
+		{"txt changed", map[string][]string{"A": {"100.64.0.2"}, "TXT": {"os=windows", "online=true", "lastseen=2024-05-01T12:00:00Z"}}, false},
+		{"address changed", map[string][]string{"A": {"100.64.0.3"}, "TXT": {"os=linux", "online=true", "lastseen=2024-05-01T12:00:00Z"}}, false},
+	}
+	for _, tc := range tests {
+		if got := sameRecords(a, tc.b); got != tc.want {
+			t.Errorf("%s: sameRecords = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		SelfNode: (&tailcfg.Node{
+			ComputedName: "self",
+			Addresses:    []netip.Prefix{netip.MustParsePrefix("100.0.0.1/32")},
+			Tags:         []string{"tag:web"},
+		}).View(),
+	}
+	old := &Tailscale{zone: "example.com"}
+	old.processNetMap(nm)
+
+	// The reloaded instance may configure the zone differently, the entries
+	// are built anew from the netmap.
+	reloaded := &Tailscale{zone: "example.org", txt: true}
+	if reloaded.Ready() {
+		t.Fatal("expected not ready before resume")
+	}
+	reloaded.resume()
+	if !reloaded.Ready() {
+		t.Fatal("expected ready after resume")
+	}
+	if got := reloaded.entries["self"]["A"]; !slices.Equal(got, []string{"100.0.0.1"}) {
+		t.Errorf("A = %v, want [100.0.0.1]", got)
+	}
+	if _, ok := reloaded.entries["self"]["TXT"]; !ok {
+		t.Error("expected TXT records of the reloaded configuration")
+	}
+}
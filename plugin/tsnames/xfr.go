@@ -0,0 +1,117 @@
+package tailscale
+
+import (
+	"fmt"
+	"net"
+	"slices"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/coredns/coredns/plugin/transfer"
+
+	"github.com/miekg/dns"
+)
+
+// Transfer implements the transfer.Transferer interface.
+func (t *Tailscale) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	t.mu.RLock()
+	if !t.isApex(zone) {
+		t.mu.RUnlock()
+		return nil, transfer.ErrNotAuthoritative
+	}
+	zone, _ = t.zoneOf(zone)
+
+	soa := t.soa(zone)
+	if serial != 0 && serial >= soa.Serial {
+		t.mu.RUnlock()
+		ch := make(chan []dns.RR, 1)
+		ch <- []dns.RR{soa}
+		close(ch)
+		return ch, nil
+	}
+
+	ns := dns.Msg{}
+	t.resolveNS(zone, &ns)
+	records := append(ns.Answer, t.zoneRecords(zone)...)
+	t.mu.RUnlock()
+
+	ch := make(chan []dns.RR)
+	go func() {
+		ch <- []dns.RR{soa}
+		ch <- records
+		ch <- []dns.RR{soa}
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// zoneRecords returns all records of the zone, sorted by owner name. The
+// caller must hold t.mu.
+func (t *Tailscale) zoneRecords(zone string) []dns.RR {
+	names := make([]string, 0, len(t.entries))
+	for name := range t.entries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var records []dns.RR
+	for _, name := range names {
+		owner := dnsutil.Join(name, dns.Fqdn(zone))
+		entry := t.entries[name]
+
+		for _, a := range entry["A"] {
+			records = append(records, &dns.A{
+				Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.ttl)},
+				A:   net.ParseIP(a),
+			})
+		}
+		for _, aaaa := range entry["AAAA"] {
+			records = append(records, &dns.AAAA{
+				Hdr:  dns.RR_Header{Name: owner, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.ttl)},
+				AAAA: net.ParseIP(aaaa),
+			})
+		}
+		for _, target := range entry["CNAME"] {
+			records = append(records, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: owner, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: t.answerTTL(name, t.cnameTTL)},
+				Target: t.qualify(target, zone),
+			})
+		}
+		if txt, ok := entry["TXT"]; ok {
+			records = append(records, &dns.TXT{
+				Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: t.ttl},
+				Txt: txt,
+			})
+		}
+		for _, srv := range entry["SRV"] {
+			rr, err := t.newSRV(owner, srv)
+			if err != nil {
+				log.Errorf("Malformed SRV entry %q for %s: %v", srv, name, err)
+				continue
+			}
+			rr.Target = t.qualify(rr.Target, zone)
+			records = append(records, rr)
+		}
+	}
+	return records
+}
+
+// newSRV builds the SRV record of owner from an entry in "PRIORITY WEIGHT PORT TARGET" form.
+func (t *Tailscale) newSRV(owner, entry string) (*dns.SRV, error) {
+	srv := &dns.SRV{
+		Hdr: dns.RR_Header{Name: owner, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: t.ttl},
+	}
+	if _, err := fmt.Sscan(entry, &srv.Priority, &srv.Weight, &srv.Port, &srv.Target); err != nil {
+		return nil, err
+	}
+	return srv, nil
+}
+
+// notify sends NOTIFY messages for the zones to the secondaries configured in
+// the transfer plugin.
+func notify(xfer *transfer.Transfer, zones []string) {
+	for _, zone := range zones {
+		if err := xfer.Notify(dns.Fqdn(zone)); err != nil {
+			log.Warningf("Failed sending notifies for %s: %s", zone, err)
+		}
+	}
+}
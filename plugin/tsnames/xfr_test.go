@@ -0,0 +1,103 @@
+package tailscale
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/transfer"
+
+	"github.com/miekg/dns"
+)
+
+func TestTransfer(t *testing.T) {
+	ts := newTS()
+	ts.self = "test1"
+	ts.serial = 10
+
+	if _, err := ts.Transfer("example.org.", 0); !errors.Is(err, transfer.ErrNotAuthoritative) {
+		t.Fatalf("expected ErrNotAuthoritative for another zone, got %v", err)
+	}
+
+	ch, err := ts.Transfer("example.com.", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var records []dns.RR
+	for rrs := range ch {
+		records = append(records, rrs...)
+	}
+
+	var got []string
+	for _, rr := range records {
+		got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype])
+	}
+	want := []string{
+		"example.com. SOA",
+		"example.com. NS",
+		"_http._tcp.example.com. SRV",
+		"test1.example.com. A",
+		"test1.example.com. AAAA",
+		"test1.example.com. TXT",
+		"test2.example.com. CNAME",
+		"test2.example.com. CNAME",
+		"test2-1.example.com. A",
+		"test2-1.example.com. AAAA",
+		"test2-2.example.com. A",
+		"test2-2.example.com. AAAA",
+		"example.com. SOA",
+	}
+	testEquals(t, "AXFR records", want, got)
+	testEquals(t, "NS", "test1.example.com.", records[1].(*dns.NS).Ns)
+}
+
+func TestTransferAdditionalZone(t *testing.T) {
+	ts := newTS()
+	ts.zones = []string{"example.org"}
+
+	ch, err := ts.Transfer("example.org.", 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for rrs := range ch {
+		for _, rr := range rrs {
+			if !dns.IsSubDomain("example.org.", rr.Header().Name) {
+				t.Errorf("record %s outside the transferred zone", rr)
+			}
+			if cname, ok := rr.(*dns.CNAME); ok && !dns.IsSubDomain("example.org.", cname.Target) {
+				t.Errorf("CNAME target %s outside the transferred zone", cname.Target)
+			}
+		}
+	}
+}
+
+func TestTransferIXFR(t *testing.T) {
+	ts := newTS()
+	ts.serial = 10
+
+	// A secondary that is up to date only gets the SOA.
+	for _, serial := range []uint32{10, 11} {
+		ch, err := ts.Transfer("example.com.", serial)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var records []dns.RR
+		for rrs := range ch {
+			records = append(records, rrs...)
+		}
+		testEquals(t, "IXFR record count", 1, len(records))
+		testEquals(t, "IXFR serial", uint32(10), records[0].(*dns.SOA).Serial)
+	}
+
+	// An outdated one falls back to AXFR.
+	ch, err := ts.Transfer("example.com.", 9)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var records []dns.RR
+	for rrs := range ch {
+		records = append(records, rrs...)
+	}
+	if len(records) < 3 {
+		t.Errorf("expected AXFR fallback, got %d records", len(records))
+	}
+}
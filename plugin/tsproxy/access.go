@@ -0,0 +1,200 @@
+package tsproxy
+
+import (
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/geoip"
+
+	"golang.org/x/time/rate"
+)
+
+// gateSweepInterval is how often a gate forgets idle sources.
+const gateSweepInterval = time.Minute
+
+// More reasons of rejected connections.
+const (
+	rejectDenied    = "denied"
+	rejectRateLimit = "rate_limit"
+	rejectMaxConns  = "max_conns"
+)
+
+// access is the configuration of who may use the channels of a port.
+type access struct {
+	// trusted may send a PROXY protocol header, see acceptProxy.
+	trusted []*net.IPNet
+
+	allow, deny                   []*net.IPNet
+	allowCountries, denyCountries []string
+	geoip                         *countryDB
+
+	// rateCount new connections per ratePer are allowed from a source, and
+	// maxConns at the same time. Zero means no limit.
+	rateCount int
+	ratePer   time.Duration
+	maxConns  int
+}
+
+// permits reports whether ip passes the allow and deny lists. A deny always
+// wins, with any allow configured the source has to match one of them.
+func (a *access) permits(ip netip.Addr) bool {
+	var country string
+	if a.geoip != nil && len(a.allowCountries)+len(a.denyCountries) > 0 {
+		var ok bool
+		if country, ok = a.geoip.country(ip); !ok {
+			// The database is closed, the country filters can't be applied.
+			return false
+		}
+	}
+	if containsIP(a.deny, ip.AsSlice()) || country != "" && slices.Contains(a.denyCountries, country) {
+		return false
+	}
+	if len(a.allow) == 0 && len(a.allowCountries) == 0 {
+		return true
+	}
+	return containsIP(a.allow, ip.AsSlice()) || country != "" && slices.Contains(a.allowCountries, country)
+}
+
+// countryDB is the geoip database of the country filters. A reload closes it
+// once the old instance admits no more connections, see setup.
+type countryDB struct {
+	mu sync.RWMutex
+	db *geoip.GeoIP
+}
+
+// country returns the country code of ip, empty if the database doesn't know
+// it. ok is false if the database is closed.
+func (d *countryDB) country(ip netip.Addr) (code string, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.db == nil {
+		return "", false
+	}
+	return d.db.CountryCode(ip), true
+}
+
+func (d *countryDB) close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db == nil {
+		return nil
+	}
+	err := d.db.Close()
+	d.db = nil
+	return err
+}
+
+// gate enforces an access configuration on the connections of one listener.
+// A nil gate admits everyone.
+type gate struct {
+	access     *access
+	protocol   string
+	listenPort string
+
+	mu        sync.Mutex
+	sources   map[netip.Addr]*source
+	lastSweep time.Time
+}
+
+type source struct {
+	limiter *rate.Limiter
+	active  int
+	last    time.Time
+}
+
+func newGate(protocol, listenPort string, a *access) *gate {
+	if a == nil {
+		return nil
+	}
+	return &gate{access: a, protocol: protocol, listenPort: listenPort, sources: map[netip.Addr]*source{}}
+}
+
+// admit decides whether the client at addr may open a connection. If it may,
+// the connection counts against the client's limits until release is called,
+// otherwise the rejection is counted and ok is false.
+func (g *gate) admit(addr net.Addr) (release func(), ok bool) {
+	if g == nil {
+		return func() {}, true
+	}
+
+	var ip netip.Addr
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.AddrPort().Addr().Unmap()
+	case *net.UDPAddr:
+		ip = addr.AddrPort().Addr().Unmap()
+	}
+
+	reason := g.check(ip)
+	if reason != "" {
+		log.Debugf("rejecting connection on port %s from %s: %s", g.listenPort, addr, reason)
+		rejectedCount.WithLabelValues(g.protocol, g.listenPort, reason).Inc()
+		return nil, false
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if s, ok := g.sources[ip]; ok {
+				s.active--
+				s.last = time.Now()
+			}
+		})
+	}, true
+}
+
+// check returns why ip may not connect, or an empty string if it may. On
+// success the connection is accounted to ip.
+func (g *gate) check(ip netip.Addr) string {
+	if !ip.IsValid() || !g.access.permits(ip) {
+		return rejectDenied
+	}
+	if g.access.rateCount == 0 && g.access.maxConns == 0 {
+		return ""
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.sweep(now)
+
+	s, ok := g.sources[ip]
+	if !ok {
+		s = &source{}
+		if g.access.rateCount > 0 {
+			s.limiter = rate.NewLimiter(rate.Every(g.access.ratePer/time.Duration(g.access.rateCount)), g.access.rateCount)
+		}
+		g.sources[ip] = s
+	}
+	s.last = now
+
+	if g.access.maxConns > 0 && s.active >= g.access.maxConns {
+		return rejectMaxConns
+	}
+	if s.limiter != nil && !s.limiter.AllowN(now, 1) {
+		return rejectRateLimit
+	}
+	s.active++
+	return ""
+}
+
+// sweep forgets sources without connections whose rate limit has refilled,
+// so they would start from scratch anyway. It runs at most every
+// gateSweepInterval and must be called with mu held.
+func (g *gate) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < gateSweepInterval {
+		return
+	}
+	g.lastSweep = now
+	for ip, s := range g.sources {
+		if s.active == 0 && now.Sub(s.last) >= g.access.ratePer {
+			delete(g.sources, ip)
+		}
+	}
+}
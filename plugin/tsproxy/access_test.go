@@ -0,0 +1,105 @@
+package tsproxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/geoip"
+)
+
+func TestAccessPermits(t *testing.T) {
+	g, err := geoip.Open("../geoip/testdata/GeoLite2-City.mmdb")
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	db := &countryDB{db: g}
+	t.Cleanup(func() { db.close() })
+
+	tests := []struct {
+		name   string
+		access *access
+		ip     string
+		want   bool
+	}{
+		{name: "open", access: &access{}, ip: "192.0.2.1", want: true},
+		{name: "allowed", access: &access{allow: mustCIDR(t, "192.0.2.0/24")}, ip: "192.0.2.1", want: true},
+		{name: "not allowed", access: &access{allow: mustCIDR(t, "192.0.2.0/24")}, ip: "198.51.100.1", want: false},
+		{name: "denied", access: &access{deny: mustCIDR(t, "192.0.2.0/24")}, ip: "192.0.2.1", want: false},
+		{name: "deny wins", access: &access{allow: mustCIDR(t, "192.0.2.0/24"), deny: mustCIDR(t, "192.0.2.1/32")}, ip: "192.0.2.1", want: false},
+		{name: "allowed country", access: &access{geoip: db, allowCountries: []string{"GB"}}, ip: "81.2.69.142", want: true},
+		{name: "other country", access: &access{geoip: db, allowCountries: []string{"DE"}}, ip: "81.2.69.142", want: false},
+		{name: "unknown country", access: &access{geoip: db, allowCountries: []string{"GB"}}, ip: "203.0.113.1", want: false},
+		{name: "denied country", access: &access{geoip: db, denyCountries: []string{"GB"}}, ip: "81.2.69.142", want: false},
+		{name: "allowed network or country", access: &access{geoip: db, allow: mustCIDR(t, "203.0.113.0/24"), allowCountries: []string{"GB"}}, ip: "203.0.113.1", want: true},
+	}
+	for _, tc := range tests {
+		if got := tc.access.permits(netip.MustParseAddr(tc.ip)); got != tc.want {
+			t.Errorf("%s: permits(%s) = %v, want %v", tc.name, tc.ip, got, tc.want)
+		}
+	}
+}
+
+func TestGateLimits(t *testing.T) {
+	port := itoa(freePort(t))
+	g := newGate("tcp", port, &access{rateCount: 2, ratePer: time.Hour, maxConns: 1})
+	client := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	other := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}
+
+	release, ok := g.admit(client)
+	if !ok {
+		t.Fatal("first connection rejected")
+	}
+	if _, ok := g.admit(client); ok {
+		t.Error("second concurrent connection admitted")
+	}
+	if _, ok := g.admit(other); !ok {
+		t.Error("connection of another client rejected")
+	}
+	release()
+	release() // releasing twice is harmless
+
+	release, ok = g.admit(client)
+	if !ok {
+		t.Fatal("connection after release rejected")
+	}
+	release()
+	if _, ok := g.admit(client); ok {
+		t.Error("connection beyond the rate limit admitted")
+	}
+
+	if got := metric(t, rejectedCount.WithLabelValues("tcp", port, rejectMaxConns)); got != 1 {
+		t.Errorf("max_conns rejections = %v, want 1", got)
+	}
+	if got := metric(t, rejectedCount.WithLabelValues("tcp", port, rejectRateLimit)); got != 1 {
+		t.Errorf("rate_limit rejections = %v, want 1", got)
+	}
+}
+
+func TestTcpProxyDenied(t *testing.T) {
+	d := &recordingDialer{}
+	listenPort := freePort(t)
+	proxy, err := NewTcpProxy(d, channel{protocol: "tcp", myPort: listenPort, targets: local(tcpEcho(t)), access: &access{deny: mustCIDR(t, "127.0.0.0/8")}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	conn := dialTCP(t, listenPort)
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("read = %v, want the connection closed", err)
+	}
+	if got := d.recorded(); len(got) != 0 {
+		t.Errorf("dialed %v, want nothing", got)
+	}
+	if !eventually(t, time.Second, func() bool {
+		return metric(t, rejectedCount.WithLabelValues("tcp", itoa(listenPort), rejectDenied)) == 1
+	}) {
+		t.Error("denied connection not counted")
+	}
+}
@@ -0,0 +1,139 @@
+package tsproxy
+
+import (
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/replacer"
+)
+
+// defaultAccessLogFormat is the text format of access_log without a format.
+const defaultAccessLogFormat = "{remote}:{port} {channel} {listen_port} -> {target} {bytes_up} {bytes_down} {duration} {reason}"
+
+// Reasons a connection or UDP session ended.
+const (
+	closeNormal    = "closed"
+	closeShutdown  = "shutdown"
+	closeIdle      = "idle"
+	closeDialError = "dial_error"
+	closeNoRoute   = "no_route"
+	closeError     = "error"
+)
+
+// accessLogger writes a line for every finished connection or UDP session of
+// an admitted client, either as JSON or in a text format with placeholders
+// like the log plugin's. A nil accessLogger writes nothing.
+type accessLogger struct {
+	json   bool
+	format string
+}
+
+// connEntry is what the access log knows about a connection.
+type connEntry struct {
+	remote     net.Addr
+	channel    string
+	listenPort string
+	target     string // empty if no target was reached
+	start      time.Time
+	up, down   int64
+	reason     string
+}
+
+func newConnEntry(channel, listenPort string, remote net.Addr) *connEntry {
+	return &connEntry{remote: remote, channel: channel, listenPort: listenPort, start: time.Now(), reason: closeNormal}
+}
+
+func (l *accessLogger) write(e *connEntry) {
+	if l == nil {
+		return
+	}
+
+	host, port, err := net.SplitHostPort(e.remote.String())
+	if err != nil {
+		host, port = e.remote.String(), ""
+	}
+	duration := time.Since(e.start).Seconds()
+
+	if l.json {
+		b, err := json.Marshal(struct {
+			Remote     string  `json:"remote"`
+			Port       string  `json:"port"`
+			Channel    string  `json:"channel"`
+			ListenPort string  `json:"listen_port"`
+			Target     string  `json:"target"`
+			BytesUp    int64   `json:"bytes_up"`
+			BytesDown  int64   `json:"bytes_down"`
+			Duration   float64 `json:"duration"`
+			Reason     string  `json:"reason"`
+		}{host, port, e.channel, e.listenPort, e.target, e.up, e.down, duration, e.reason})
+		if err != nil {
+			connLog.Errorf("encoding access log entry: %v", err)
+			return
+		}
+		connLog.Info(string(b))
+		return
+	}
+
+	connLog.Info(accessLogReplacer.Replace(l.format, func(b []byte, label string) []byte {
+		return appendValue(b, e, host, port, duration, label)
+	}))
+}
+
+// closeReason returns why a connection that ran until its end was closed.
+func closeReason(quit <-chan any) string {
+	select {
+	case <-quit:
+		return closeShutdown
+	default:
+		return closeNormal
+	}
+}
+
+// accessLogReplacer replaces the placeholders of the text format.
+var accessLogReplacer = replacer.NewCustom(
+	"{remote}", "{port}", "{channel}", "{listen_port}", "{target}",
+	"{bytes_up}", "{bytes_down}", "{duration}", "{reason}",
+)
+
+// appendValue appends the value of label for e, with the remote address
+// split into host and port.
+func appendValue(b []byte, e *connEntry, host, port string, duration float64, label string) []byte {
+	switch label {
+	case "{remote}":
+		if host == "" {
+			return append(b, replacer.EmptyValue...)
+		}
+		if strings.IndexByte(host, ':') != -1 {
+			return append(append(append(b, '['), host...), ']')
+		}
+		return append(b, host...)
+	case "{port}":
+		return appendOrEmpty(b, port)
+	case "{channel}":
+		return append(b, e.channel...)
+	case "{listen_port}":
+		return append(b, e.listenPort...)
+	case "{target}":
+		return appendOrEmpty(b, e.target)
+	case "{bytes_up}":
+		return strconv.AppendInt(b, e.up, 10)
+	case "{bytes_down}":
+		return strconv.AppendInt(b, e.down, 10)
+	case "{duration}":
+		return append(strconv.AppendFloat(b, duration, 'f', -1, 64), 's')
+	case "{reason}":
+		return append(b, e.reason...)
+	default:
+		return append(b, replacer.EmptyValue...)
+	}
+}
+
+func appendOrEmpty(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, replacer.EmptyValue...)
+	}
+	return append(b, s...)
+}
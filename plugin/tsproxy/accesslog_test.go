@@ -0,0 +1,148 @@
+package tsproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	golog "log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects what the proxies log, it is safe for concurrent use.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+func captureLog(t *testing.T) *logBuffer {
+	t.Helper()
+	var b logBuffer
+	golog.SetOutput(&b)
+	t.Cleanup(func() { golog.SetOutput(os.Stderr) })
+	return &b
+}
+
+func TestAccessLogWrite(t *testing.T) {
+	entry := &connEntry{
+		remote:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 4242},
+		channel:    "tcp",
+		listenPort: "2222",
+		target:     "hub:22",
+		start:      time.Now(),
+		up:         10,
+		down:       20,
+		reason:     closeNormal,
+	}
+
+	tests := []struct {
+		name   string
+		logger *accessLogger
+		entry  *connEntry
+		want   string
+	}{
+		{
+			name:   "default",
+			logger: &accessLogger{format: defaultAccessLogFormat},
+			entry:  entry,
+			want:   "[2001:db8::1]:4242 tcp 2222 -> hub:22 10 20 ",
+		},
+		{
+			name:   "custom",
+			logger: &accessLogger{format: "{remote} {reason} {unknown}"},
+			entry:  entry,
+			want:   "[2001:db8::1] closed {unknown}",
+		},
+		{
+			name:   "braces",
+			logger: &accessLogger{format: "} { {remote} }"},
+			entry:  entry,
+			want:   "} { [2001:db8::1] }",
+		},
+		{
+			name:   "no target",
+			logger: &accessLogger{format: "{target} {reason}"},
+			entry:  &connEntry{remote: entry.remote, start: time.Now(), reason: closeDialError},
+			want:   "- dial_error",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b := captureLog(t)
+			tc.logger.write(tc.entry)
+			if got := b.lines(); len(got) != 1 || !strings.Contains(got[0], "plugin/tsproxy/access: "+tc.want) {
+				t.Errorf("logged %q, want it to contain %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	b := captureLog(t)
+	(&accessLogger{json: true}).write(&connEntry{
+		remote:     &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4242},
+		channel:    "udp",
+		listenPort: "443",
+		target:     "hub:443",
+		start:      time.Now(),
+		up:         1,
+		down:       2,
+		reason:     closeIdle,
+	})
+
+	line := b.lines()[0]
+	var got map[string]any
+	if err := json.Unmarshal([]byte(line[strings.IndexByte(line, '{'):]), &got); err != nil {
+		t.Fatalf("logged %q: %v", line, err)
+	}
+	for k, want := range map[string]any{
+		"remote": "192.0.2.1", "port": "4242", "channel": "udp", "listen_port": "443",
+		"target": "hub:443", "bytes_up": 1.0, "bytes_down": 2.0, "reason": "idle",
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %v, want %v", k, got[k], want)
+		}
+	}
+	if _, ok := got["duration"].(float64); !ok {
+		t.Errorf("duration = %v, want seconds", got["duration"])
+	}
+}
+
+func TestAccessLogTcpProxy(t *testing.T) {
+	b := captureLog(t)
+	echoPort := tcpEcho(t)
+	listenPort := freePort(t)
+
+	proxy, err := NewTcpProxy(&recordingDialer{}, channel{protocol: "tcp", myPort: listenPort, targets: local(echoPort), accessLog: &accessLogger{format: "{remote} {channel} {listen_port} -> {target} {bytes_up} {bytes_down} {reason}"}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	conn := dialTCP(t, listenPort)
+	conn.Write([]byte("hello"))
+	readN(t, conn, 5)
+	conn.Close()
+
+	want := "127.0.0.1 tcp " + itoa(listenPort) + " -> " + local(echoPort)[0] + " 5 5 closed"
+	if !eventually(t, 2*time.Second, func() bool {
+		return strings.Contains(strings.Join(b.lines(), "\n"), want)
+	}) {
+		t.Errorf("logged %q, want a line with %q", b.lines(), want)
+	}
+}
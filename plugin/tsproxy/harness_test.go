@@ -1,8 +1,10 @@
 package tsproxy
 
 import (
+	"context"
 	"io"
 	"net"
+	"sync"
 	"testing"
 	"time"
 
@@ -25,6 +27,29 @@ func freePort(t *testing.T) int {
 	return port
 }
 
+// recordingDialer is a fake dialer that connects over the host network stack
+// and records every network/address pair the proxies asked it to dial.
+type recordingDialer struct {
+	mu    sync.Mutex
+	dials []string
+}
+
+func (d *recordingDialer) Dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dials = append(d.dials, network+" "+address)
+	d.mu.Unlock()
+
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, address)
+}
+
+// recorded returns a copy of the dials seen so far.
+func (d *recordingDialer) recorded() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.dials...)
+}
+
 // tcpEcho starts a TCP server on 127.0.0.1 that echoes everything it reads back
 // on the same connection. It returns the port and is cleaned up automatically.
 func tcpEcho(t *testing.T) int {
@@ -1,9 +1,11 @@
 package tsproxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strconv"
 	"time"
 
@@ -14,35 +16,60 @@ type HttpsRedirect struct {
 	server *http.Server
 }
 
-func NewHttpsRedirect(protocol string, srcPort int, targetPort int) *HttpsRedirect {
+// NewHttpsRedirect listens on the port of the https_redirect channel ch and
+// redirects its requests to HTTPS on the channel's target port.
+func NewHttpsRedirect(ch channel) (*HttpsRedirect, error) {
 	redirect := &HttpsRedirect{}
 
-	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", srcPort))
+	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", ch.myPort))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	listenPort := strconv.Itoa(srcPort)
+	listenPort := strconv.Itoa(ch.myPort)
+	listener = acceptProxy(listener, ch.protocol, listenPort, ch.access)
+	gate := newGate(ch.protocol, listenPort, ch.access)
 	redirect.server = &http.Server{
 		ReadHeaderTimeout: 5 * time.Second,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			connectionsCount.WithLabelValues(protocol, listenPort, "").Inc()
+			connectionsCount.WithLabelValues(ch.protocol, listenPort, "").Inc()
+			var client net.Addr
+			if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+				client = net.TCPAddrFromAddrPort(addr)
+			}
+			release, ok := gate.admit(client)
+			if !ok {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			defer release()
 			host := r.Host
 			if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
 				host = hostname
 			}
-			if targetPort != 443 {
-				host = fmt.Sprintf("%s:%d", host, targetPort)
+			if ch.targetPort != 443 {
+				host = fmt.Sprintf("%s:%d", host, ch.targetPort)
 			}
 			target := "https://" + host + r.RequestURI
 			http.Redirect(w, r, target, http.StatusMovedPermanently) //nolint:gosec // intentional: transparent HTTP→HTTPS protocol upgrade
 		}),
 	}
 
-	httpsRedirectLog.Infof("starting HTTP->HTTPS redirect on port %d (target port %d)", srcPort, targetPort)
+	httpsRedirectLog.Infof("starting HTTP->HTTPS redirect on port %d (target port %d)", ch.myPort, ch.targetPort)
 
 	go redirect.server.Serve(listener)
-	return redirect
+	return redirect, nil
+}
+
+// httpsRedirectHandoverTimeout bounds how long a handover waits for in-flight
+// redirects.
+const httpsRedirectHandoverTimeout = 5 * time.Second
+
+// Handover stops accepting connections and waits for in-flight redirects.
+func (r *HttpsRedirect) Handover() {
+	ctx, cancel := context.WithTimeout(context.Background(), httpsRedirectHandoverTimeout)
+	defer cancel()
+	r.server.Shutdown(ctx)
 }
 
 func (r *HttpsRedirect) Close() {
@@ -20,7 +20,10 @@ func TestHttpsRedirect(t *testing.T) {
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
 			listenPort := freePort(t)
-			redirect := NewHttpsRedirect("https_redirect", listenPort, tc.targetPort)
+			redirect, err := NewHttpsRedirect(channel{protocol: "https_redirect", myPort: listenPort, targetPort: tc.targetPort})
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
 			t.Cleanup(redirect.Close)
 
 			before := metric(t, connectionsCount.WithLabelValues("https_redirect", itoa(listenPort), ""))
@@ -13,7 +13,7 @@ var (
 		Namespace: plugin.Namespace,
 		Subsystem: "tsproxy",
 		Name:      "connections_total",
-		Help:      "Counter of connections handled (TCP: per accepted connection, UDP: per client session, https_redirect: per request).",
+		Help:      "Counter of connections handled (TCP: per connection to a target, UDP: per client session, https_redirect: per request).",
 	}, []string{"protocol", "listen_port", "target"})
 
 	proxiedBytesCount = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -45,6 +45,20 @@ var (
 		Name:      "active_connections",
 		Help:      "Gauge of currently open connections/sessions.",
 	}, []string{"protocol", "listen_port", "target"})
+
+	backendHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tsproxy",
+		Name:      "backend_healthy",
+		Help:      "Gauge of the health of each target (1: up, 0: down after max_fails failures).",
+	}, []string{"protocol", "listen_port", "target"})
+
+	rejectedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "tsproxy",
+		Name:      "rejected_connections_total",
+		Help:      "Counter of connections dropped before reaching a target, by reason.",
+	}, []string{"protocol", "listen_port", "reason"})
 )
 
 const (
@@ -0,0 +1,240 @@
+package tsproxy
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies for choosing the backend of a connection, named like forward's.
+const (
+	policyRoundRobin = "round_robin"
+	policyLeastConn  = "least_conn"
+	policySequential = "sequential"
+)
+
+// defaultMaxFails is how many failed dials or health checks in a row mark a
+// backend down, unless configured otherwise.
+const defaultMaxFails = 2
+
+// healthCheckTimeout bounds a single health check.
+const healthCheckTimeout = 2 * time.Second
+
+// downRetryInterval is how long a backend stays down without health checks.
+// After it, connections try the backend in its turn again.
+const downRetryInterval = 30 * time.Second
+
+// balancing is the configuration of how the channels of a port spread
+// connections over their targets.
+type balancing struct {
+	policy string
+	// maxFails failures in a row mark a backend down, zero never does.
+	maxFails int
+	// healthCheck is the interval of active health checks, zero disables them.
+	healthCheck time.Duration
+}
+
+var defaultBalancing = &balancing{policy: policyRoundRobin, maxFails: defaultMaxFails}
+
+// healthSeries counts the pools using each backend_healthy series. A reload
+// creates the new pools before it stops the old ones, so a series is only
+// deleted once no pool reports it anymore.
+var (
+	healthSeriesMu sync.Mutex
+	healthSeries   = map[[3]string]int{}
+)
+
+// pool spreads the connections of a channel over its backends.
+type pool struct {
+	dialer     dialer
+	protocol   string
+	listenPort string
+	balancing  *balancing
+	backends   []*backend
+
+	next     atomic.Uint64 // round_robin position
+	quit     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	// stopped is set under healthSeriesMu once the pool no longer reports
+	// the health of its backends.
+	stopped bool
+}
+
+type backend struct {
+	addr   string
+	fails  atomic.Int32
+	active atomic.Int64
+	// downSince is when the last failure of a down backend happened, in
+	// Unix nanoseconds.
+	downSince atomic.Int64
+}
+
+// newPool creates the pool of targets and starts its health checks. A nil
+// balancing uses the defaults.
+func newPool(d dialer, protocol, listenPort string, targets []string, b *balancing) *pool {
+	if b == nil {
+		b = defaultBalancing
+	}
+	p := &pool{dialer: d, protocol: protocol, listenPort: listenPort, balancing: b, quit: make(chan struct{})}
+	healthSeriesMu.Lock()
+	for _, t := range targets {
+		p.backends = append(p.backends, &backend{addr: t})
+		healthSeries[[3]string{protocol, listenPort, t}]++
+		backendHealthy.WithLabelValues(protocol, listenPort, t).Set(1)
+	}
+	healthSeriesMu.Unlock()
+
+	if b.healthCheck > 0 {
+		p.wg.Go(p.healthChecks)
+	}
+	return p
+}
+
+// dial connects to a backend, trying them in the order of the policy until
+// one answers. The caller must call release with the returned backend once
+// the connection ends.
+func (p *pool) dial(ctx context.Context, network string) (net.Conn, *backend, error) {
+	var err error
+	for _, b := range p.order() {
+		var conn net.Conn
+		conn, err = p.dialer.Dial(ctx, network, b.addr)
+		if err != nil {
+			log.Errorf("error dialing %s on port %s: %v", b.addr, p.listenPort, err)
+			p.fail(b)
+			continue
+		}
+		p.succeed(b)
+		b.active.Add(1)
+		return conn, b, nil
+	}
+	return nil, nil, err
+}
+
+func (p *pool) release(b *backend) {
+	b.active.Add(-1)
+}
+
+// order returns the backends in the order a connection tries them: healthy
+// ones as the policy says, then the ones that are down as a last resort.
+func (p *pool) order() []*backend {
+	order := slices.Clone(p.backends)
+	switch p.balancing.policy {
+	case policyRoundRobin:
+		n := int((p.next.Add(1) - 1) % uint64(len(order)))
+		order = append(order[n:], order[:n]...)
+	case policyLeastConn:
+		slices.SortStableFunc(order, func(a, b *backend) int {
+			return int(a.active.Load() - b.active.Load())
+		})
+	}
+	slices.SortStableFunc(order, func(a, b *backend) int {
+		return boolInt(!p.healthy(a)) - boolInt(!p.healthy(b))
+	})
+	return order
+}
+
+// healthy reports whether b is up. Without health checks, a backend that is
+// down counts as up again after downRetryInterval, so that connections find
+// out whether it came back.
+func (p *pool) healthy(b *backend) bool {
+	if p.balancing.maxFails == 0 || int(b.fails.Load()) < p.balancing.maxFails {
+		return true
+	}
+	return p.balancing.healthCheck == 0 && time.Since(time.Unix(0, b.downSince.Load())) >= downRetryInterval
+}
+
+func (p *pool) fail(b *backend) {
+	if p.balancing.maxFails == 0 {
+		return
+	}
+	fails := int(b.fails.Add(1))
+	if fails >= p.balancing.maxFails {
+		b.downSince.Store(time.Now().UnixNano())
+	}
+	if fails == p.balancing.maxFails {
+		log.Warningf("backend %s on port %s is down", b.addr, p.listenPort)
+		p.setHealthy(b, 0)
+	}
+}
+
+func (p *pool) succeed(b *backend) {
+	if p.balancing.maxFails > 0 && int(b.fails.Swap(0)) >= p.balancing.maxFails {
+		log.Infof("backend %s on port %s is up", b.addr, p.listenPort)
+		p.setHealthy(b, 1)
+	}
+}
+
+// setHealthy reports the health of b, unless the pool is stopped and its
+// series may belong to another pool or be gone.
+func (p *pool) setHealthy(b *backend, v float64) {
+	healthSeriesMu.Lock()
+	defer healthSeriesMu.Unlock()
+	if !p.stopped {
+		backendHealthy.WithLabelValues(p.protocol, p.listenPort, b.addr).Set(v)
+	}
+}
+
+// healthChecks connects to every backend over TCP each interval. UDP
+// backends are checked on the same port, e.g. a web server's TCP port for
+// HTTP/3.
+func (p *pool) healthChecks() {
+	ticker := time.NewTicker(p.balancing.healthCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			for _, b := range p.backends {
+				p.check(b)
+			}
+		}
+	}
+}
+
+func (p *pool) check(b *backend) {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	conn, err := p.dialer.Dial(ctx, "tcp", b.addr)
+	if err != nil {
+		log.Debugf("health check of %s on port %s failed: %v", b.addr, p.listenPort, err)
+		p.fail(b)
+		return
+	}
+	conn.Close()
+	p.succeed(b)
+}
+
+// stop ends the health checks and deletes the health series no other pool
+// uses.
+func (p *pool) stop() {
+	p.stopOnce.Do(func() {
+		close(p.quit)
+		p.wg.Wait()
+
+		healthSeriesMu.Lock()
+		defer healthSeriesMu.Unlock()
+		p.stopped = true
+		for _, b := range p.backends {
+			key := [3]string{p.protocol, p.listenPort, b.addr}
+			if healthSeries[key]--; healthSeries[key] <= 0 {
+				delete(healthSeries, key)
+				backendHealthy.DeleteLabelValues(p.protocol, p.listenPort, b.addr)
+			}
+		}
+	})
+	p.wg.Wait()
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,170 @@
+package tsproxy
+
+import (
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func backendAddrs(backends []*backend) []string {
+	var addrs []string
+	for _, b := range backends {
+		addrs = append(addrs, b.addr)
+	}
+	return addrs
+}
+
+func TestPoolOrder(t *testing.T) {
+	targets := []string{"a:1", "b:1", "c:1"}
+
+	rr := newPool(nil, "tcp", "1", targets, nil)
+	for _, want := range [][]string{{"a:1", "b:1", "c:1"}, {"b:1", "c:1", "a:1"}, {"c:1", "a:1", "b:1"}, {"a:1", "b:1", "c:1"}} {
+		if got := backendAddrs(rr.order()); !slices.Equal(got, want) {
+			t.Errorf("round_robin order = %v, want %v", got, want)
+		}
+	}
+
+	lc := newPool(nil, "tcp", "1", targets, &balancing{policy: policyLeastConn, maxFails: 1})
+	lc.backends[0].active.Store(2)
+	lc.backends[1].active.Store(1)
+	if got, want := backendAddrs(lc.order()), []string{"c:1", "b:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("least_conn order = %v, want %v", got, want)
+	}
+
+	seq := newPool(nil, "tcp", "1", targets, &balancing{policy: policySequential, maxFails: 1})
+	seq.fail(seq.backends[0])
+	if got, want := backendAddrs(seq.order()), []string{"b:1", "c:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("sequential order with a:1 down = %v, want %v", got, want)
+	}
+	seq.succeed(seq.backends[0])
+	if got, want := backendAddrs(seq.order()), []string{"a:1", "b:1", "c:1"}; !slices.Equal(got, want) {
+		t.Errorf("sequential order with a:1 up = %v, want %v", got, want)
+	}
+}
+
+func TestPoolDownRetry(t *testing.T) {
+	targets := []string{"a:1", "b:1"}
+
+	p := newPool(nil, "tcp", "1", targets, &balancing{policy: policySequential, maxFails: 1})
+	p.fail(p.backends[0])
+	if got, want := backendAddrs(p.order()), []string{"b:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("order with a:1 down = %v, want %v", got, want)
+	}
+	p.backends[0].downSince.Store(time.Now().Add(-downRetryInterval).UnixNano())
+	if got, want := backendAddrs(p.order()), []string{"a:1", "b:1"}; !slices.Equal(got, want) {
+		t.Errorf("order after the retry interval = %v, want %v", got, want)
+	}
+	// Failing again keeps it down for another interval.
+	p.fail(p.backends[0])
+	if got, want := backendAddrs(p.order()), []string{"b:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("order after another failure = %v, want %v", got, want)
+	}
+
+	// Health checks decide on their own when a backend is back.
+	hc := newPool(nil, "tcp", "1", targets, &balancing{policy: policySequential, maxFails: 1, healthCheck: time.Hour})
+	t.Cleanup(hc.stop)
+	hc.fail(hc.backends[0])
+	hc.backends[0].downSince.Store(time.Now().Add(-downRetryInterval).UnixNano())
+	if got, want := backendAddrs(hc.order()), []string{"b:1", "a:1"}; !slices.Equal(got, want) {
+		t.Errorf("order with health checks = %v, want %v", got, want)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	port := itoa(freePort(t))
+	dead, alive := local(freePort(t))[0], local(tcpEcho(t))[0]
+
+	d := &recordingDialer{}
+	p := newPool(d, "tcp", port, []string{dead, alive}, &balancing{policy: policySequential, maxFails: 1})
+
+	conn, b, err := p.dial(context.Background(), "tcp")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.Close()
+	p.release(b)
+
+	if b.addr != alive {
+		t.Errorf("dialed %s, want %s", b.addr, alive)
+	}
+	if got, want := d.recorded(), []string{"tcp " + dead, "tcp " + alive}; !slices.Equal(got, want) {
+		t.Errorf("dials = %v, want %v", got, want)
+	}
+	if got := metric(t, backendHealthy.WithLabelValues("tcp", port, dead)); got != 0 {
+		t.Errorf("healthy(%s) = %v, want 0", dead, got)
+	}
+	if got := metric(t, backendHealthy.WithLabelValues("tcp", port, alive)); got != 1 {
+		t.Errorf("healthy(%s) = %v, want 1", alive, got)
+	}
+
+	// The dead backend is now tried last.
+	if _, _, err := p.dial(context.Background(), "tcp"); err != nil {
+		t.Fatalf("second dial: %v", err)
+	}
+	if got := d.recorded(); len(got) != 3 || got[2] != "tcp "+alive {
+		t.Errorf("dials = %v, want %s dialed first", got, alive)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	port := itoa(freePort(t))
+	backendPort := freePort(t)
+	target := local(backendPort)[0]
+
+	p := newPool(&recordingDialer{}, "tcp", port, []string{target}, &balancing{policy: policyRoundRobin, maxFails: 1, healthCheck: 10 * time.Millisecond})
+	t.Cleanup(p.stop)
+
+	if !eventually(t, 2*time.Second, func() bool {
+		return metric(t, backendHealthy.WithLabelValues("tcp", port, target)) == 0
+	}) {
+		t.Fatal("backend without a listener not marked down")
+	}
+
+	l, err := net.Listen("tcp", target)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	if !eventually(t, 2*time.Second, func() bool {
+		return metric(t, backendHealthy.WithLabelValues("tcp", port, target)) == 1
+	}) {
+		t.Error("listening backend not marked up")
+	}
+}
+
+func TestPoolStopDeletesSeries(t *testing.T) {
+	port := itoa(freePort(t))
+	before := testutil.CollectAndCount(backendHealthy)
+
+	// A reload drops b:1, the new pool starts before the old one stops.
+	old := newPool(nil, "tcp", port, []string{"a:1", "b:1"}, nil)
+	reloaded := newPool(nil, "tcp", port, []string{"a:1"}, nil)
+	if got := testutil.CollectAndCount(backendHealthy) - before; got != 2 {
+		t.Errorf("%d series while both pools run, want 2", got)
+	}
+
+	old.stop()
+	if got := testutil.CollectAndCount(backendHealthy) - before; got != 1 {
+		t.Errorf("%d series after the old pool stopped, want 1", got)
+	}
+	if got := metric(t, backendHealthy.WithLabelValues("tcp", port, "a:1")); got != 1 {
+		t.Errorf("healthy(a:1) = %v, want 1", got)
+	}
+
+	// A stopped pool doesn't report anymore.
+	old.fail(old.backends[0])
+	old.fail(old.backends[0])
+	if got := metric(t, backendHealthy.WithLabelValues("tcp", port, "a:1")); got != 1 {
+		t.Errorf("healthy(a:1) = %v after the old pool failed it, want 1", got)
+	}
+
+	reloaded.stop()
+	if got := testutil.CollectAndCount(backendHealthy) - before; got != 0 {
+		t.Errorf("%d series after both pools stopped, want 0", got)
+	}
+}
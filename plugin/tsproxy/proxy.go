@@ -1,43 +1,108 @@
 package tsproxy
 
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/coredns/coredns/plugin"
+)
+
+// dialer opens the upstream connections of the proxies. The global tailscale
+// instance implements it, so targets are reached through the tailnet even when
+// the host kernel has no route to it (userspace networking, embedded tsnet).
+type dialer interface {
+	Dial(ctx context.Context, network, address string) (net.Conn, error)
+}
+
 type channel struct {
-	protocol   string
-	myPort     int
-	target     string
+	protocol string
+	myPort   int
+	// targets are the backends as host:port, connections are spread over
+	// them as balancing says.
+	targets []string
+	// targetPort is the port https_redirect redirects to.
 	targetPort int
+
+	// routes of a tls_sni channel, which has no single target.
+	routes []sniRoute
+
+	// proxyV2 makes tcp_proxy send PROXY protocol v2 instead of v1, with
+	// proxyTLVs it adds TLVs from the TLS ClientHello.
+	proxyV2   bool
+	proxyTLVs bool
+
+	// access limits who may use the channel, nil means anyone.
+	access *access
+	// balancing of the targets, nil means the defaults.
+	balancing *balancing
+	// accessLog logs the channel's connections, nil means no logging.
+	accessLog *accessLogger
 }
 
 type closeable interface {
+	// Handover stops listening and lets open connections finish, so another
+	// instance can take over the port.
+	Handover()
 	Close()
 }
 
 type tsproxy struct {
+	next    plugin.Handler
+	dialer  dialer
 	proxies []closeable
+
+	// started is set once all proxies are created, it guards reading proxies
+	// from Ready.
+	started atomic.Bool
 }
 
-func (proxy *tsproxy) start(channels []channel) {
+// start binds and runs the proxies of all channels. If a port can't be bound,
+// the proxies started so far are closed again and the error is returned, so a
+// reload fails and the previous instance keeps serving.
+func (proxy *tsproxy) start(channels []channel) error {
 	log.Infof("starting tsproxy on %d channels", len(channels))
 
 	// run the proxies
 	for _, channel := range channels {
 		var p closeable
+		var err error
 		switch channel.protocol {
-		case "udp":
-			p = NewUdpProxy(channel.protocol, channel.myPort, channel.target, channel.targetPort)
+		case "udp", "udp_proxy":
+			p, err = NewUdpProxy(proxy.dialer, channel)
 		case "tcp":
-			p = NewTcpProxy(channel.protocol, channel.myPort, channel.target, channel.targetPort)
+			p, err = NewTcpProxy(proxy.dialer, channel)
 		case "tcp_proxy":
-			p = NewTcpProxyProxy(channel.protocol, channel.myPort, channel.target, channel.targetPort)
+			p, err = NewTcpProxyProxy(proxy.dialer, channel)
+		case "tls_sni":
+			p, err = NewSniProxy(proxy.dialer, channel)
 		case "https_redirect":
-			p = NewHttpsRedirect(channel.protocol, channel.myPort, channel.targetPort)
+			p, err = NewHttpsRedirect(channel)
 		default:
 			panic("Unknown protocol for tsproxy: " + channel.protocol)
 		}
+		if err != nil {
+			proxy.close()
+			proxy.proxies = nil
+			return fmt.Errorf("listening on %s port %d: %w", channel.protocol, channel.myPort, err)
+		}
 
 		proxy.proxies = append(proxy.proxies, p)
 	}
 
+	proxy.started.Store(true)
 	log.Infof("%d proxies started", len(proxy.proxies))
+	return nil
+}
+
+// handover stops listening on all channels without cutting open connections.
+// On reload the new instance already listens on the same ports, SO_REUSEPORT
+// lets both bind them, so nothing is refused in between.
+func (proxy *tsproxy) handover() {
+	for _, p := range proxy.proxies {
+		p.Handover()
+	}
 }
 
 func (proxy *tsproxy) close() {
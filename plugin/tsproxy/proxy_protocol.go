@@ -0,0 +1,66 @@
+package tsproxy
+
+import (
+	"net"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyHeaderTimeout bounds how long a trusted sender may take to send its
+// PROXY protocol header.
+const proxyHeaderTimeout = 5 * time.Second
+
+// Reasons of rejected connections.
+const (
+	rejectUntrusted   = "untrusted_proxy"
+	rejectProxyHeader = "proxy_header"
+)
+
+// acceptProxy wraps l so connections carry the client address from their
+// PROXY protocol v1 or v2 header. Only senders in the trusted networks of a
+// may connect and they must send a header, anyone else is dropped. Without
+// trusted networks l is returned as is.
+func acceptProxy(l net.Listener, protocol, listenPort string, a *access) net.Listener {
+	if a == nil || len(a.trusted) == 0 {
+		return l
+	}
+	return &proxyproto.Listener{
+		Listener:          l,
+		ReadHeaderTimeout: proxyHeaderTimeout,
+		ConnPolicy: func(opts proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+			if addr, ok := opts.Upstream.(*net.TCPAddr); ok && containsIP(a.trusted, addr.IP) {
+				return proxyproto.REQUIRE, nil
+			}
+			log.Debugf("rejecting connection on port %s from untrusted %s", listenPort, opts.Upstream)
+			rejectedCount.WithLabelValues(protocol, listenPort, rejectUntrusted).Inc()
+			// the listener drops the connection and keeps accepting
+			return proxyproto.REJECT, proxyproto.ErrInvalidUpstream
+		},
+	}
+}
+
+// readProxyHeader reads the PROXY protocol header of a connection accepted
+// through acceptProxy, so its RemoteAddr is the client. A missing or invalid
+// header is counted as rejected and returned as error.
+func readProxyHeader(conn net.Conn, protocol, listenPort string) error {
+	pc, ok := conn.(*proxyproto.Conn)
+	if !ok {
+		return nil
+	}
+	// reading nothing only processes the header
+	if _, err := pc.Read(nil); err != nil {
+		rejectedCount.WithLabelValues(protocol, listenPort, rejectProxyHeader).Inc()
+		return err
+	}
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+package tsproxy
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+)
+
+// proxyTarget starts a TCP server that reports the PROXY header of each
+// connection. It returns the port.
+func proxyTarget(t *testing.T, headers chan<- *proxyproto.Header) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("proxyTarget listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			header, _ := proxyproto.Read(bufio.NewReader(conn))
+			headers <- header
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func mustCIDR(t *testing.T, s string) []*net.IPNet {
+	t.Helper()
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("parse %s: %v", s, err)
+	}
+	return []*net.IPNet{n}
+}
+
+func TestAcceptProxyTrusted(t *testing.T) {
+	headers := make(chan *proxyproto.Header, 1)
+	targetPort := proxyTarget(t, headers)
+	listenPort := freePort(t)
+
+	proxy, err := NewTcpProxyProxy(&recordingDialer{}, channel{protocol: "tcp_proxy", myPort: listenPort, targets: local(targetPort), proxyV2: true, access: &access{trusted: mustCIDR(t, "127.0.0.0/8")}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	conn := dialTCP(t, listenPort)
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4242 443\r\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	select {
+	case header := <-headers:
+		if header == nil {
+			t.Fatal("target got no PROXY header")
+		}
+		if src, _, ok := header.TCPAddrs(); !ok || src.String() != "203.0.113.7:4242" {
+			t.Errorf("target got client %v, want 203.0.113.7:4242", header.SourceAddr)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no connection at the target")
+	}
+}
+
+func TestAcceptProxyRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		header  string
+		reason  string
+	}{
+		{name: "untrusted", trusted: "10.0.0.0/8", header: "PROXY TCP4 203.0.113.7 127.0.0.1 4242 443\r\n", reason: rejectUntrusted},
+		{name: "no header", trusted: "127.0.0.0/8", header: "GET / HTTP/1.0\r\n\r\n", reason: rejectProxyHeader},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &recordingDialer{}
+			listenPort := freePort(t)
+			proxy, err := NewTcpProxy(d, channel{protocol: "tcp", myPort: listenPort, targets: local(freePort(t)), access: &access{trusted: mustCIDR(t, tc.trusted)}})
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			t.Cleanup(proxy.Close)
+
+			conn := dialTCP(t, listenPort)
+			t.Cleanup(func() { conn.Close() })
+			conn.Write([]byte(tc.header))
+
+			// The proxy hangs up without dialing the target.
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+				t.Errorf("read = %v, want the connection closed", err)
+			}
+			if got := d.recorded(); len(got) != 0 {
+				t.Errorf("dialed %v, want nothing", got)
+			}
+			if !eventually(t, time.Second, func() bool {
+				return metric(t, rejectedCount.WithLabelValues("tcp", itoa(listenPort), tc.reason)) == 1
+			}) {
+				t.Errorf("rejected count for %s not incremented", tc.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,24 @@
+package tsproxy
+
+import (
+	"context"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/miekg/dns"
+)
+
+// ServeDNS implements plugin.Handler. tsproxy doesn't handle DNS, it is in the
+// plugin chain only so the ready plugin can find it.
+func (proxy *tsproxy) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	return plugin.NextOrFailure(proxy.Name(), proxy.next, ctx, w, r)
+}
+
+// Name implements plugin.Handler.
+func (proxy *tsproxy) Name() string { return "tsproxy" }
+
+// Ready implements the ready.Readiness interface. tsproxy is ready once all
+// channels listen, which they do as soon as start returns.
+func (proxy *tsproxy) Ready() bool {
+	return proxy.started.Load()
+}
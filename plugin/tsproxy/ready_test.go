@@ -0,0 +1,25 @@
+package tsproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	proxy := &tsproxy{dialer: &recordingDialer{}}
+	if proxy.Ready() {
+		t.Fatal("expected not ready before start")
+	}
+
+	if err := proxy.start([]channel{
+		{protocol: "tcp", myPort: freePort(t), targets: local(tcpEcho(t))},
+		{protocol: "udp", myPort: freePort(t), targets: local(udpEcho(t))},
+	}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(proxy.close)
+
+	if !eventually(t, 2*time.Second, proxy.Ready) {
+		t.Fatal("expected ready once all listeners are bound")
+	}
+}
@@ -0,0 +1,110 @@
+package tsproxy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestReload mimics a Corefile reload that changes the channels: the new
+// instance starts while the old one still runs, then the old one hands over.
+// Open connections must survive, removed ports must stop listening and the
+// kept and added ones must be served by the new instance.
+func TestReload(t *testing.T) {
+	oldEcho, newEcho, udpTarget := tcpEcho(t), tcpEcho(t), udpEcho(t)
+	kept, removed, added, udpPort := freePort(t), freePort(t), freePort(t), freePort(t)
+
+	old := &tsproxy{dialer: &recordingDialer{}}
+	if err := old.start([]channel{
+		{protocol: "tcp", myPort: kept, targets: local(oldEcho)},
+		{protocol: "tcp", myPort: removed, targets: local(oldEcho)},
+		{protocol: "udp", myPort: udpPort, targets: local(udpTarget)},
+	}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(old.close)
+
+	open := dialTCP(t, kept)
+	defer open.Close()
+	roundtrip(t, open, "before reload")
+	udpConn := dialUDP(t, udpPort)
+	defer udpConn.Close()
+	udpRoundtrip(t, udpConn, []byte("before reload"))
+
+	d := &recordingDialer{}
+	reloaded := &tsproxy{dialer: d}
+	if err := reloaded.start([]channel{
+		{protocol: "tcp", myPort: kept, targets: local(newEcho)},
+		{protocol: "tcp", myPort: added, targets: local(newEcho)},
+		{protocol: "udp", myPort: udpPort, targets: local(udpTarget)},
+	}); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	t.Cleanup(reloaded.close)
+	if !eventually(t, 2*time.Second, reloaded.Ready) {
+		t.Fatal("reloaded instance not ready")
+	}
+	old.handover()
+
+	// The connection accepted by the old instance is not cut.
+	roundtrip(t, open, "after reload")
+
+	// New connections reach the new targets.
+	for _, port := range []int{kept, added} {
+		conn := dialTCP(t, port)
+		roundtrip(t, conn, "new connection")
+		conn.Close()
+	}
+	newDst := fmt.Sprintf("tcp 127.0.0.1:%d", newEcho)
+	if dials := d.recorded(); slices.Index(dials, newDst) < 0 {
+		t.Errorf("expected the new instance to dial %s, got %v", newDst, dials)
+	}
+
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", removed)); err == nil {
+		conn.Close()
+		t.Errorf("expected the removed port %d to be closed", removed)
+	}
+
+	udpRoundtrip(t, udpConn, []byte("after reload"))
+}
+
+// TestReloadPortInUse checks that a reload adding a port another process holds
+// fails without leaving the other ports of the new instance bound.
+func TestReloadPortInUse(t *testing.T) {
+	held, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { held.Close() })
+	free := freePort(t)
+
+	proxy := &tsproxy{dialer: &recordingDialer{}}
+	err = proxy.start([]channel{
+		{protocol: "tcp", myPort: free, targets: local(tcpEcho(t))},
+		{protocol: "tcp", myPort: held.Addr().(*net.TCPAddr).Port, targets: local(tcpEcho(t))},
+	})
+	if err == nil {
+		proxy.close()
+		t.Fatal("expected start to fail on a port in use")
+	}
+	if proxy.Ready() {
+		t.Error("expected not ready after a failed start")
+	}
+	if conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", free)); err == nil {
+		conn.Close()
+		t.Errorf("expected port %d to be released", free)
+	}
+}
+
+// roundtrip writes payload to conn and expects it echoed back.
+func roundtrip(t *testing.T, conn net.Conn, payload string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(payload)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if got := readN(t, conn, len(payload)); string(got) != payload {
+		t.Fatalf("echo mismatch: got %q want %q", got, payload)
+	}
+}
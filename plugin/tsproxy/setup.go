@@ -2,12 +2,20 @@ package tsproxy
 
 import (
 	"fmt"
+	"net"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/geoip"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/plugin/tailscale"
+
+	"github.com/miekg/dns"
 )
 
 var log = clog.NewWithPlugin("tsproxy")
@@ -15,6 +23,8 @@ var tcpLog = clog.NewWithPlugin("tsproxy/tcp")
 var tcpProxyLog = clog.NewWithPlugin("tsproxy/tcp_proxy")
 var udpLog = clog.NewWithPlugin("tsproxy/udp")
 var httpsRedirectLog = clog.NewWithPlugin("tsproxy/https_redirect")
+var sniLog = clog.NewWithPlugin("tsproxy/tls_sni")
+var connLog = clog.NewWithPlugin("tsproxy/access")
 
 func init() {
 	plugin.Register("tsproxy", setup)
@@ -27,17 +37,36 @@ func setup(c *caddy.Controller) error {
 	}
 
 	proxy := &tsproxy{}
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		proxy.next = next
+		return proxy
+	})
+
 	c.OnStartup(func() error {
 		if tailscale.GetGlobalTailscale() == nil {
 			return fmt.Errorf("tsproxy: tailscale plugin not initialized")
 		}
 
-		proxy.start(channels)
+		proxy.dialer = tailscale.GetGlobalTailscale()
+		if err := proxy.start(channels); err != nil {
+			return fmt.Errorf("tsproxy: %w", err)
+		}
 		return nil
 	})
 
+	// A reload only shuts this instance down after the new one is listening,
+	// so hand the ports over and leave open connections alone. They are only
+	// cut when CoreDNS exits.
 	c.OnShutdown(func() error {
+		proxy.handover()
+		// Connections accepted before the handover are still admitted once
+		// their PROXY header arrived, keep the geoip database open for them.
+		time.AfterFunc(proxyHeaderTimeout, func() { closeGeoIP(channels) })
+		return nil
+	})
+	c.OnFinalShutdown(func() error {
 		proxy.close()
+		closeGeoIP(channels)
 		return nil
 	})
 
@@ -47,8 +76,16 @@ func setup(c *caddy.Controller) error {
 // parseChannels reads the tsproxy block(s) from the Corefile and returns the
 // list of configured proxy channels. It is split out of setup so it can be
 // tested without the startup/shutdown wiring.
-func parseChannels(c *caddy.Controller) ([]channel, error) {
-	var channels []channel
+func parseChannels(c *caddy.Controller) (channels []channel, err error) {
+	accesses := map[int]*access{}
+	balancings := map[int]*balancing{}
+	var db *countryDB
+	defer func() {
+		if db != nil && (err != nil || len(accesses) == 0) {
+			db.close()
+		}
+	}()
+	var accessLog *accessLogger
 	for c.Next() {
 		for c.NextBlock() {
 			switch c.Val() {
@@ -68,14 +105,21 @@ func parseChannels(c *caddy.Controller) ([]channel, error) {
 					return nil, fmt.Errorf("invalid numeral for target port %s", args[2])
 				}
 
+				if i := portChannel(channels, "tcp", int(mp)); i >= 0 {
+					return nil, c.Errf("https_redirect: TCP port %d is already used by %s", mp, channels[i].protocol)
+				}
 				channels = append(channels, channel{
 					protocol:   "https_redirect",
 					myPort:     int(mp),
 					targetPort: int(tp),
 				})
-			case "udp", "tcp", "tcp_proxy":
+			case "udp", "udp_proxy", "tcp", "tcp_proxy":
 				protocol := c.Val()
 				args := c.RemainingArgs()
+				var opts []string
+				if protocol == "tcp_proxy" && len(args) > 4 {
+					args, opts = args[:4], args[4:]
+				}
 				if len(args) != 4 || args[1] != "->" {
 					return nil, fmt.Errorf("unexpected format for %s, expected: %s <listen_port> -> <target_host> <target_port>", protocol, protocol)
 				}
@@ -90,17 +134,360 @@ func parseChannels(c *caddy.Controller) ([]channel, error) {
 					return nil, fmt.Errorf("invalid numeral for target port %s", args[3])
 				}
 
-				channels = append(channels, channel{
-					protocol:   protocol,
-					myPort:     int(mp),
-					target:     args[2],
-					targetPort: int(tp),
+				ch := channel{protocol: protocol, myPort: int(mp)}
+				target := net.JoinHostPort(args[2], strconv.Itoa(int(tp)))
+				switch {
+				case len(opts) == 0, len(opts) == 1 && opts[0] == "v1":
+				case len(opts) == 1 && opts[0] == "v2":
+					ch.proxyV2 = true
+				case len(opts) == 2 && opts[0] == "v2" && opts[1] == "tls":
+					ch.proxyV2, ch.proxyTLVs = true, true
+				default:
+					return nil, fmt.Errorf("unexpected options for tcp_proxy %s, expected: v1 or v2 [tls]", strings.Join(opts, " "))
+				}
+
+				// Lines with the same protocol and port list the targets of one channel.
+				i := slices.IndexFunc(channels, func(other channel) bool {
+					return other.protocol == protocol && other.myPort == ch.myPort
 				})
+				if i < 0 {
+					network := strings.TrimSuffix(protocol, "_proxy")
+					if j := portChannel(channels, network, ch.myPort); j >= 0 {
+						return nil, c.Errf("%s: %s port %d is already used by %s", protocol, strings.ToUpper(network), mp, channels[j].protocol)
+					}
+					channels = append(channels, ch)
+					i = len(channels) - 1
+				}
+				if channels[i].proxyV2 != ch.proxyV2 || channels[i].proxyTLVs != ch.proxyTLVs {
+					return nil, fmt.Errorf("conflicting PROXY protocol options for %s on port %d", protocol, mp)
+				}
+				if slices.Contains(channels[i].targets, target) {
+					return nil, fmt.Errorf("duplicate %s target %s on port %d", protocol, target, mp)
+				}
+				channels[i].targets = append(channels[i].targets, target)
+			case "tls_sni":
+				args := c.RemainingArgs()
+				if len(args) != 5 || args[2] != "->" {
+					return nil, fmt.Errorf("unexpected format for tls_sni, expected: tls_sni <listen_port> <server_name> -> <target_host> <target_port>")
+				}
+
+				mp, err := strconv.ParseUint(args[0], 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid numeral for listen port %s", args[0])
+				}
+
+				tp, err := strconv.ParseUint(args[4], 10, 16)
+				if err != nil {
+					return nil, fmt.Errorf("invalid numeral for target port %s", args[4])
+				}
+
+				pattern := strings.TrimSuffix(strings.ToLower(args[1]), ".")
+				if !validSNIPattern(pattern) {
+					return nil, fmt.Errorf("invalid server name %s, expected a host name, *.domain or %s", args[1], sniDefault)
+				}
+				target := net.JoinHostPort(args[3], strconv.Itoa(int(tp)))
+
+				// All routes of a port share one listener, so they form one channel.
+				i := slices.IndexFunc(channels, func(ch channel) bool {
+					return ch.protocol == "tls_sni" && ch.myPort == int(mp)
+				})
+				if i < 0 {
+					if j := portChannel(channels, "tcp", int(mp)); j >= 0 {
+						return nil, c.Errf("tls_sni: TCP port %d is already used by %s", mp, channels[j].protocol)
+					}
+					channels = append(channels, channel{protocol: "tls_sni", myPort: int(mp)})
+					i = len(channels) - 1
+				}
+				// Lines with the same server name list the targets of one route.
+				routes := channels[i].routes
+				j := slices.IndexFunc(routes, func(r sniRoute) bool { return r.pattern == pattern })
+				if j < 0 {
+					routes = append(routes, sniRoute{pattern: pattern})
+					j = len(routes) - 1
+				}
+				if slices.Contains(routes[j].targets, target) {
+					return nil, fmt.Errorf("duplicate tls_sni target %s for %s on port %d", target, args[1], mp)
+				}
+				routes[j].targets = append(routes[j].targets, target)
+				channels[i].routes = routes
+			case "accept_proxy", "allow", "deny":
+				directive := c.Val()
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, fmt.Errorf("unexpected format for %s, expected: %s <listen_port> <cidr>...", directive, directive)
+				}
+
+				a, err := portAccess(accesses, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				for _, v := range args[1:] {
+					_, ipnet, err := net.ParseCIDR(v)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %s: %w", directive, v, err)
+					}
+					switch directive {
+					case "accept_proxy":
+						a.trusted = append(a.trusted, ipnet)
+					case "allow":
+						a.allow = append(a.allow, ipnet)
+					case "deny":
+						a.deny = append(a.deny, ipnet)
+					}
+				}
+			case "allow_country", "deny_country":
+				directive := c.Val()
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, fmt.Errorf("unexpected format for %s, expected: %s <listen_port> <country_code>...", directive, directive)
+				}
+
+				a, err := portAccess(accesses, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				for _, v := range args[1:] {
+					code := strings.ToUpper(v)
+					if len(code) != 2 || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+						return nil, fmt.Errorf("%s: invalid country code %s, expected two letters like DE", directive, v)
+					}
+					if directive == "allow_country" {
+						a.allowCountries = append(a.allowCountries, code)
+					} else {
+						a.denyCountries = append(a.denyCountries, code)
+					}
+				}
+			case "policy":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, fmt.Errorf("unexpected format for policy, expected: policy <listen_port> %s|%s|%s", policyRoundRobin, policyLeastConn, policySequential)
+				}
+
+				b, err := portBalancing(balancings, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				switch args[1] {
+				case policyRoundRobin, policyLeastConn, policySequential:
+					b.policy = args[1]
+				default:
+					return nil, fmt.Errorf("unknown policy %s, expected: %s, %s or %s", args[1], policyRoundRobin, policyLeastConn, policySequential)
+				}
+			case "health_check":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, fmt.Errorf("unexpected format for health_check, expected: health_check <listen_port> <duration>")
+				}
+
+				b, err := portBalancing(balancings, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				d, err := time.ParseDuration(args[1])
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("health_check: invalid duration %s", args[1])
+				}
+				b.healthCheck = d
+			case "max_fails":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, fmt.Errorf("unexpected format for max_fails, expected: max_fails <listen_port> <count>")
+				}
+
+				b, err := portBalancing(balancings, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("max_fails: invalid count %s", args[1])
+				}
+				b.maxFails = n
+			case "geoip":
+				args := c.RemainingArgs()
+				if len(args) != 1 {
+					return nil, fmt.Errorf("unexpected format for geoip, expected: geoip <database_file>")
+				}
+				if db != nil {
+					return nil, fmt.Errorf("geoip: configuring multiple databases is not supported")
+				}
+				g, err := geoip.Open(args[0])
+				if err != nil {
+					return nil, fmt.Errorf("geoip: %w", err)
+				}
+				db = &countryDB{db: g}
+			case "access_log":
+				args := c.RemainingArgs()
+				if len(args) > 1 {
+					return nil, fmt.Errorf("unexpected format for access_log, expected: access_log [text|json|<format>]")
+				}
+				if accessLog != nil {
+					return nil, fmt.Errorf("access_log: configuring multiple access logs is not supported")
+				}
+
+				accessLog = &accessLogger{format: defaultAccessLogFormat}
+				switch {
+				case len(args) == 0 || args[0] == "text":
+				case args[0] == "json":
+					accessLog.json = true
+				case strings.Contains(args[0], "{"):
+					accessLog.format = args[0]
+				default:
+					return nil, fmt.Errorf("access_log: unknown format %s, expected: text, json or a format with placeholders", args[0])
+				}
+			case "rate_limit":
+				args := c.RemainingArgs()
+				if len(args) != 3 {
+					return nil, fmt.Errorf("unexpected format for rate_limit, expected: rate_limit <listen_port> <connections> <duration>")
+				}
+
+				a, err := portAccess(accesses, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("rate_limit: invalid number of connections %s", args[1])
+				}
+				d, err := time.ParseDuration(args[2])
+				if err != nil || d <= 0 {
+					return nil, fmt.Errorf("rate_limit: invalid duration %s", args[2])
+				}
+				a.rateCount, a.ratePer = n, d
+			case "max_conns":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, fmt.Errorf("unexpected format for max_conns, expected: max_conns <listen_port> <connections>")
+				}
+
+				a, err := portAccess(accesses, args[0])
+				if err != nil {
+					return nil, err
+				}
+
+				n, err := strconv.Atoi(args[1])
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("max_conns: invalid number of connections %s", args[1])
+				}
+				a.maxConns = n
 			default:
 				return nil, fmt.Errorf("unexpected token %s", c.Val())
 			}
 		}
 	}
 
+	// The access settings of a port apply to all its channels, whichever line
+	// comes first. Only TCP listeners accept PROXY headers.
+	for port, a := range accesses {
+		a.geoip = db
+		if (len(a.allowCountries) > 0 || len(a.denyCountries) > 0) && db == nil {
+			return nil, fmt.Errorf("country filters on port %d need a geoip database", port)
+		}
+		found, tcp := false, false
+		for i := range channels {
+			if channels[i].myPort == port {
+				channels[i].access = a
+				found = true
+				tcp = tcp || channels[i].protocol != "udp" && channels[i].protocol != "udp_proxy"
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("access settings for port %d without a channel", port)
+		}
+		if len(a.trusted) > 0 && !tcp {
+			return nil, fmt.Errorf("accept_proxy: no TCP channel on port %d", port)
+		}
+	}
+
+	for port, b := range balancings {
+		found := false
+		for i := range channels {
+			if channels[i].myPort == port && channels[i].protocol != "https_redirect" {
+				channels[i].balancing = b
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("balancing settings for port %d without a channel with targets", port)
+		}
+	}
+
+	// The access log covers all channels, https_redirect has no connections to log.
+	for i := range channels {
+		if channels[i].protocol != "https_redirect" {
+			channels[i].accessLog = accessLog
+		}
+	}
+
 	return channels, nil
 }
+
+// closeGeoIP closes the geoip database of the channels, if any. The new
+// instance already serves when it runs, so failing to close is only logged.
+func closeGeoIP(channels []channel) {
+	for _, ch := range channels {
+		if ch.access != nil && ch.access.geoip != nil {
+			if err := ch.access.geoip.close(); err != nil {
+				log.Warningf("Unable to close the geoip database: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// portChannel returns the index of the channel listening on port of network
+// (tcp or udp), or -1. A port of a network can only serve one kind of channel.
+func portChannel(channels []channel, network string, port int) int {
+	return slices.IndexFunc(channels, func(ch channel) bool {
+		udp := ch.protocol == "udp" || ch.protocol == "udp_proxy"
+		return ch.myPort == port && udp == (network == "udp")
+	})
+}
+
+// portAccess returns the access settings of the listen port arg.
+func portAccess(accesses map[int]*access, arg string) (*access, error) {
+	mp, err := strconv.ParseUint(arg, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid numeral for listen port %s", arg)
+	}
+	a, ok := accesses[int(mp)]
+	if !ok {
+		a = &access{}
+		accesses[int(mp)] = a
+	}
+	return a, nil
+}
+
+// portBalancing returns the balancing settings of the listen port arg.
+func portBalancing(balancings map[int]*balancing, arg string) (*balancing, error) {
+	mp, err := strconv.ParseUint(arg, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid numeral for listen port %s", arg)
+	}
+	b, ok := balancings[int(mp)]
+	if !ok {
+		b = &balancing{policy: policyRoundRobin, maxFails: defaultMaxFails}
+		balancings[int(mp)] = b
+	}
+	return b, nil
+}
+
+// validSNIPattern reports whether p is a host name, a wildcard *.domain or the
+// default route.
+func validSNIPattern(p string) bool {
+	if p == sniDefault {
+		return true
+	}
+	name := strings.TrimPrefix(p, "*.")
+	if name == "" || strings.Contains(name, "*") {
+		return false
+	}
+	_, ok := dns.IsDomainName(name)
+	return ok
+}
@@ -1,13 +1,27 @@
 package tsproxy
 
 import (
+	"net"
+	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/coredns/caddy"
 
 	"github.com/google/go-cmp/cmp"
 )
 
+var accessSettings = &access{
+	trusted:   []*net.IPNet{{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)}},
+	allow:     []*net.IPNet{{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(8, 128)}},
+	deny:      []*net.IPNet{{IP: net.IP{10, 1, 0, 0}, Mask: net.CIDRMask(16, 32)}},
+	rateCount: 10,
+	ratePer:   time.Minute,
+	maxConns:  4,
+}
+
+var balancingSettings = &balancing{policy: policyLeastConn, healthCheck: 10 * time.Second}
+
 func TestParseChannels(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -18,17 +32,53 @@ func TestParseChannels(t *testing.T) {
 		{
 			name:  "tcp",
 			input: "tsproxy {\n tcp 10080 -> vrejsek 80\n}",
-			want:  []channel{{protocol: "tcp", myPort: 10080, target: "vrejsek", targetPort: 80}},
+			want:  []channel{{protocol: "tcp", myPort: 10080, targets: []string{"vrejsek:80"}}},
 		},
 		{
 			name:  "tcp_proxy",
 			input: "tsproxy {\n tcp_proxy 10443 -> vrejsek 443\n}",
-			want:  []channel{{protocol: "tcp_proxy", myPort: 10443, target: "vrejsek", targetPort: 443}},
+			want:  []channel{{protocol: "tcp_proxy", myPort: 10443, targets: []string{"vrejsek:443"}}},
+		},
+		{
+			name:  "tcp_proxy v1",
+			input: "tsproxy {\n tcp_proxy 10443 -> vrejsek 443 v1\n}",
+			want:  []channel{{protocol: "tcp_proxy", myPort: 10443, targets: []string{"vrejsek:443"}}},
+		},
+		{
+			name:  "tcp_proxy v2",
+			input: "tsproxy {\n tcp_proxy 10443 -> vrejsek 443 v2\n}",
+			want:  []channel{{protocol: "tcp_proxy", myPort: 10443, targets: []string{"vrejsek:443"}, proxyV2: true}},
+		},
+		{
+			name:  "tcp_proxy v2 tls",
+			input: "tsproxy {\n tcp_proxy 10443 -> vrejsek 443 v2 tls\n}",
+			want:  []channel{{protocol: "tcp_proxy", myPort: 10443, targets: []string{"vrejsek:443"}, proxyV2: true, proxyTLVs: true}},
+		},
+		{
+			name: "access",
+			input: `tsproxy {
+				accept_proxy 10443 10.0.0.0/8
+				tcp 10443 -> vrejsek 443
+				udp 10443 -> vrejsek 443
+				allow 10443 fd00::/8
+				deny 10443 10.1.0.0/16
+				rate_limit 10443 10 1m
+				max_conns 10443 4
+			}`,
+			want: []channel{
+				{protocol: "tcp", myPort: 10443, targets: []string{"vrejsek:443"}, access: accessSettings},
+				{protocol: "udp", myPort: 10443, targets: []string{"vrejsek:443"}, access: accessSettings},
+			},
+		},
+		{
+			name:  "udp_proxy",
+			input: "tsproxy {\n udp_proxy 10053 -> vrejsek 53\n}",
+			want:  []channel{{protocol: "udp_proxy", myPort: 10053, targets: []string{"vrejsek:53"}}},
 		},
 		{
 			name:  "udp",
 			input: "tsproxy {\n udp 10053 -> vrejsek 53\n}",
-			want:  []channel{{protocol: "udp", myPort: 10053, target: "vrejsek", targetPort: 53}},
+			want:  []channel{{protocol: "udp", myPort: 10053, targets: []string{"vrejsek:53"}}},
 		},
 		{
 			name:  "https_redirect",
@@ -43,11 +93,75 @@ func TestParseChannels(t *testing.T) {
 				https_redirect 10081 -> 8443
 			}`,
 			want: []channel{
-				{protocol: "tcp", myPort: 10080, target: "vrejsek", targetPort: 80},
-				{protocol: "udp", myPort: 10053, target: "vrejsek", targetPort: 53},
+				{protocol: "tcp", myPort: 10080, targets: []string{"vrejsek:80"}},
+				{protocol: "udp", myPort: 10053, targets: []string{"vrejsek:53"}},
 				{protocol: "https_redirect", myPort: 10081, targetPort: 8443},
 			},
 		},
+		{
+			name: "tls_sni",
+			input: `tsproxy {
+				tls_sni 10443 Service.example.org. -> hub 443
+				tls_sni 10443 *.internal.example.org -> other 8443
+				tcp 10080 -> hub 80
+				tls_sni 10443 default -> hub 443
+			}`,
+			want: []channel{
+				{protocol: "tls_sni", myPort: 10443, routes: []sniRoute{
+					{pattern: "service.example.org", targets: []string{"hub:443"}},
+					{pattern: "*.internal.example.org", targets: []string{"other:8443"}},
+					{pattern: "default", targets: []string{"hub:443"}},
+				}},
+				{protocol: "tcp", myPort: 10080, targets: []string{"hub:80"}},
+			},
+		},
+		{
+			name: "balancing",
+			input: `tsproxy {
+				tcp 10443 -> hub1 443
+				tcp 10443 -> hub2 443
+				udp 10443 -> hub1 443
+				tls_sni 10444 default -> hub1 443
+				tls_sni 10444 default -> hub2 443
+				policy 10443 least_conn
+				health_check 10443 10s
+				max_fails 10443 0
+			}`,
+			want: []channel{
+				{protocol: "tcp", myPort: 10443, targets: []string{"hub1:443", "hub2:443"}, balancing: balancingSettings},
+				{protocol: "udp", myPort: 10443, targets: []string{"hub1:443"}, balancing: balancingSettings},
+				{protocol: "tls_sni", myPort: 10444, routes: []sniRoute{
+					{pattern: "default", targets: []string{"hub1:443", "hub2:443"}},
+				}},
+			},
+		},
+		{
+			name:  "ipv6 target",
+			input: "tsproxy {\n tcp 10443 -> fd7a:115c:a1e0::1 443\n}",
+			want:  []channel{{protocol: "tcp", myPort: 10443, targets: []string{"[fd7a:115c:a1e0::1]:443"}}},
+		},
+		{
+			name: "access_log",
+			input: `tsproxy {
+				access_log
+				tcp 2222 -> hub 22
+				https_redirect 10080 -> 443
+			}`,
+			want: []channel{
+				{protocol: "tcp", myPort: 2222, targets: []string{"hub:22"}, accessLog: &accessLogger{format: defaultAccessLogFormat}},
+				{protocol: "https_redirect", myPort: 10080, targetPort: 443},
+			},
+		},
+		{
+			name:  "access_log json",
+			input: "tsproxy {\n tcp 2222 -> hub 22\n access_log json\n}",
+			want:  []channel{{protocol: "tcp", myPort: 2222, targets: []string{"hub:22"}, accessLog: &accessLogger{json: true, format: defaultAccessLogFormat}}},
+		},
+		{
+			name:  "access_log format",
+			input: "tsproxy {\n tcp 2222 -> hub 22\n access_log \"{remote} {reason}\"\n}",
+			want:  []channel{{protocol: "tcp", myPort: 2222, targets: []string{"hub:22"}, accessLog: &accessLogger{format: "{remote} {reason}"}}},
+		},
 		// Error cases.
 		{
 			name:      "short args must not panic",
@@ -74,6 +188,154 @@ func TestParseChannels(t *testing.T) {
 			input:     "tsproxy {\n https_redirect 10080 -> vrejsek 443\n}",
 			shouldErr: true,
 		},
+		{
+			name:      "tcp_proxy v1 tls",
+			input:     "tsproxy {\n tcp_proxy 10443 -> vrejsek 443 v1 tls\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tcp_proxy unknown version",
+			input:     "tsproxy {\n tcp_proxy 10443 -> vrejsek 443 v3\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tcp with proxy version",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443 v2\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "allow without channel",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n allow 10080 10.0.0.0/8\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "country without geoip",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n allow_country 10443 DE\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "invalid country",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n deny_country 10443 DEU\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "geoip missing database",
+			input:     "tsproxy {\n geoip testdata/missing.mmdb\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "rate_limit without duration",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n rate_limit 10443 10\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "max_conns zero",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n max_conns 10443 0\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "accept_proxy without channel",
+			input:     "tsproxy {\n accept_proxy 10443 10.0.0.0/8\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "accept_proxy on udp",
+			input:     "tsproxy {\n udp 10053 -> vrejsek 53\n accept_proxy 10053 10.0.0.0/8\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "accept_proxy without networks",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n accept_proxy 10443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "accept_proxy invalid network",
+			input:     "tsproxy {\n tcp 10443 -> vrejsek 443\n accept_proxy 10443 10.0.0.1\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tls_sni without server name",
+			input:     "tsproxy {\n tls_sni 10443 -> hub 443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tls_sni invalid wildcard",
+			input:     "tsproxy {\n tls_sni 10443 www.*.example.org -> hub 443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tls_sni duplicate route",
+			input:     "tsproxy {\n tls_sni 10443 default -> hub 443\n tls_sni 10443 default -> hub 443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "duplicate target",
+			input:     "tsproxy {\n tcp 10443 -> hub 443\n tcp 10443 -> hub 443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "conflicting proxy versions",
+			input:     "tsproxy {\n tcp_proxy 10443 -> hub1 443 v1\n tcp_proxy 10443 -> hub2 443 v2\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "unknown policy",
+			input:     "tsproxy {\n tcp 10443 -> hub 443\n policy 10443 random\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "health_check invalid duration",
+			input:     "tsproxy {\n tcp 10443 -> hub 443\n health_check 10443 often\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "max_fails negative",
+			input:     "tsproxy {\n tcp 10443 -> hub 443\n max_fails 10443 -1\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "policy without channel",
+			input:     "tsproxy {\n https_redirect 10080 -> 443\n policy 10080 sequential\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "access_log unknown format",
+			input:     "tsproxy {\n tcp 2222 -> hub 22\n access_log yaml\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "access_log twice",
+			input:     "tsproxy {\n tcp 2222 -> hub 22\n access_log\n access_log json\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tcp and tls_sni on one port",
+			input:     "tsproxy {\n tcp 443 -> hub 443\n tls_sni 443 git.example.org -> forge 443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "tcp and tcp_proxy on one port",
+			input:     "tsproxy {\n tcp_proxy 443 -> hub 443\n tcp 443 -> hub 8443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "https_redirect twice on one port",
+			input:     "tsproxy {\n https_redirect 80 -> 443\n https_redirect 80 -> 8443\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "udp_proxy and udp on one port",
+			input:     "tsproxy {\n udp 443 -> hub 443\n udp_proxy 443 -> hub 8443\n}",
+			shouldErr: true,
+		},
+		{
+			name:  "tcp and udp on one port",
+			input: "tsproxy {\n tcp 443 -> hub 443\n udp 443 -> hub 443\n}",
+			want: []channel{
+				{protocol: "tcp", myPort: 443, targets: []string{"hub:443"}},
+				{protocol: "udp", myPort: 443, targets: []string{"hub:443"}},
+			},
+		},
 		{
 			name:      "unknown token",
 			input:     "tsproxy {\n sctp 10080 -> vrejsek 80\n}",
@@ -94,9 +356,45 @@ func TestParseChannels(t *testing.T) {
 			if err != nil {
 				t.Fatalf("unexpected error: %v", err)
 			}
-			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(channel{})); diff != "" {
+			if diff := cmp.Diff(tc.want, got, cmp.AllowUnexported(channel{}, sniRoute{}, access{}, balancing{}, accessLogger{})); diff != "" {
 				t.Errorf("channels mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
+
+func TestParseGeoIP(t *testing.T) {
+	c := caddy.NewTestController("dns", `tsproxy {
+		geoip ../geoip/testdata/GeoLite2-City.mmdb
+		tcp 2222 -> vrejsek 22
+		allow_country 2222 de gb
+		deny_country 2222 RU
+	}`)
+	channels, err := parseChannels(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	a := channels[0].access
+	if a == nil || a.geoip == nil {
+		t.Fatal("expected access with a geoip database")
+	}
+	if diff := cmp.Diff([]string{"DE", "GB"}, a.allowCountries); diff != "" {
+		t.Errorf("allowed countries mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"RU"}, a.denyCountries); diff != "" {
+		t.Errorf("denied countries mismatch (-want +got):\n%s", diff)
+	}
+
+	// Once a reload closed the database, the country filters reject.
+	ip := netip.MustParseAddr("81.2.69.142")
+	if got, _ := a.geoip.country(ip); got != "GB" {
+		t.Errorf("country before close = %q, want GB", got)
+	}
+	closeGeoIP(channels)
+	if _, ok := a.geoip.country(ip); ok {
+		t.Error("expected no country after close")
+	}
+	if a.permits(ip) {
+		t.Error("expected a closed database to reject")
+	}
+}
@@ -22,7 +22,10 @@ func TestTcpProxyShutdownWithOpenConnection(t *testing.T) {
 	echoPort := tcpEcho(t)
 	listenPort := freePort(t)
 
-	proxy := NewTcpProxy("tcp", listenPort, "127.0.0.1", echoPort)
+	proxy, err := NewTcpProxy(&recordingDialer{}, channel{protocol: "tcp", myPort: listenPort, targets: local(echoPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 
 	conn := dialTCP(t, listenPort)
 	// Send a byte so the handler + both copy goroutines are definitely running,
@@ -52,7 +55,10 @@ func TestUdpProxyShutdown(t *testing.T) {
 	echoPort := udpEcho(t)
 	listenPort := freePort(t)
 
-	proxy := NewUdpProxy("udp", listenPort, "127.0.0.1", echoPort)
+	proxy, err := NewUdpProxy(&recordingDialer{}, channel{protocol: "udp", myPort: listenPort, targets: local(echoPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	conn := dialUDP(t, listenPort)
 	udpRoundtrip(t, conn, []byte("warmup"))
 	conn.Close()
@@ -1,10 +1,12 @@
 package tsproxy
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,32 +20,43 @@ var tcpDrainTimeout = 90 * time.Second
 
 type TcpProxy struct {
 	listener   net.Listener
+	pool       *pool
 	wg         sync.WaitGroup
 	quit       chan any
-	dst        string
+	handover   chan any
 	protocol   string
 	listenPort string
+
+	// gate admits the clients allowed by the channel's access.
+	gate *gate
+	// accessLog logs every admitted connection, if set.
+	accessLog *accessLogger
 }
 
-func NewTcpProxy(protocol string, srcPort int, dstAddr string, dstPort int) *TcpProxy {
+// NewTcpProxy listens on the port of the tcp channel ch and forwards its
+// connections to the channel's targets.
+func NewTcpProxy(d dialer, ch channel) (*TcpProxy, error) {
 	var proxy TcpProxy
 
-	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", srcPort))
+	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", ch.myPort))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	proxy.listener = listener
 	proxy.wg.Add(1)
-	proxy.dst = fmt.Sprintf("%s:%d", dstAddr, dstPort)
 	proxy.quit = make(chan any)
-	proxy.protocol = protocol
-	proxy.listenPort = strconv.Itoa(srcPort)
+	proxy.handover = make(chan any)
+	proxy.protocol = ch.protocol
+	proxy.listenPort = strconv.Itoa(ch.myPort)
+	proxy.listener = acceptProxy(listener, ch.protocol, proxy.listenPort, ch.access)
+	proxy.gate = newGate(ch.protocol, proxy.listenPort, ch.access)
+	proxy.pool = newPool(d, ch.protocol, proxy.listenPort, ch.targets, ch.balancing)
+	proxy.accessLog = ch.accessLog
 
-	tcpLog.Infof("starting TCP proxy from local port %d to %s", srcPort, proxy.dst)
+	tcpLog.Infof("starting TCP proxy from local port %d to %s", ch.myPort, strings.Join(ch.targets, ", "))
 
 	go proxy.serve()
-	return &proxy
+	return &proxy, nil
 }
 
 func (proxy *TcpProxy) serve() {
@@ -56,51 +69,81 @@ func (proxy *TcpProxy) serve() {
 			select {
 			case <-proxy.quit:
 				return
+			case <-proxy.handover:
+				return
 			default:
 				tcpLog.Errorf("accept error: %v", err)
 			}
 		} else {
 			// normal connection accepted, spawn a handler goroutine
-			connectionsCount.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Inc()
-			activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Inc()
 			proxy.wg.Go(func() {
 				proxy.handleConnection(conn)
 			})
-			tcpLog.Debugf("incomming connection from '%s' will be proxied to '%s'", conn.LocalAddr().String(), conn.RemoteAddr().String())
 		}
 	}
 }
 
+// Handover stops accepting connections, open ones continue until they end.
+func (proxy *TcpProxy) Handover() {
+	close(proxy.handover)
+	proxy.listener.Close()
+	proxy.pool.stop()
+}
+
 func (proxy *TcpProxy) Close() {
 	close(proxy.quit)
 	proxy.listener.Close()
+	proxy.pool.stop()
 	proxy.wg.Wait()
 }
 
 func (proxy *TcpProxy) handleConnection(downstream net.Conn) {
 	defer downstream.Close()
 
-	start := time.Now()
-	defer func() {
-		activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Dec()
-		connectionDuration.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Observe(time.Since(start).Seconds())
-	}()
+	// The client address may come from a PROXY header, which must be read
+	// here rather than in the accept loop.
+	if err := readProxyHeader(downstream, proxy.protocol, proxy.listenPort); err != nil {
+		tcpLog.Debugf("rejecting connection from %s: %v", downstream.RemoteAddr(), err)
+		return
+	}
+	release, ok := proxy.gate.admit(downstream.RemoteAddr())
+	if !ok {
+		return
+	}
+	defer release()
 
-	var upstream net.Conn
-	var err error
-	upstream, err = net.Dial("tcp", proxy.dst)
+	entry := newConnEntry(proxy.protocol, proxy.listenPort, downstream.RemoteAddr())
+	defer proxy.accessLog.write(entry)
 
+	upstream, b, err := proxy.pool.dial(context.Background(), "tcp")
 	if err != nil {
 		tcpLog.Errorf("error dialing remote addr: %v", err)
+		entry.reason = closeDialError
+		rejectedCount.WithLabelValues(proxy.protocol, proxy.listenPort, closeDialError).Inc()
 		return
 	}
 	defer upstream.Close()
+	defer proxy.pool.release(b)
+	entry.target = b.addr
+	tcpLog.Debugf("incoming connection from '%s' will be proxied to '%s'", downstream.RemoteAddr(), b.addr)
 
+	start := track(proxy.protocol, proxy.listenPort, b.addr)
+	defer untrack(proxy.protocol, proxy.listenPort, b.addr, start)
+
+	up, down := pipe(proxy.quit, downstream, upstream)
+	recordBytes(proxy.protocol, proxy.listenPort, b.addr, up, down)
+	entry.up, entry.down, entry.reason = up, down, closeReason(proxy.quit)
+	tcpLog.Debugf("connection from %s closed", downstream.RemoteAddr().String())
+}
+
+// pipe copies between the client and the target connection. When one direction
+// ends or quit is closed, the other is given tcpDrainTimeout to finish. It
+// returns the bytes copied client->target and target->client.
+func pipe(quit <-chan any, downstream, upstream net.Conn) (up, down int64) {
 	// Start threads for copying both ways
 	closerChannel := make(chan struct{})
 	defer close(closerChannel)
 
-	var up, down int64
 	var iowg sync.WaitGroup
 	iowg.Add(2)
 	go copy(&iowg, closerChannel, upstream, downstream, &up)   // client -> target
@@ -111,7 +154,7 @@ func (proxy *TcpProxy) handleConnection(downstream net.Conn) {
 	//  - a stop is requested from the outside
 	select {
 	case <-closerChannel:
-	case <-proxy.quit:
+	case <-quit:
 	}
 
 	// and then close the connection after the drain timeout also for the other side, if they don't close it themselves
@@ -121,8 +164,20 @@ func (proxy *TcpProxy) handleConnection(downstream net.Conn) {
 
 	// wait for both copy threads to finish
 	iowg.Wait()
-	recordBytes(proxy.protocol, proxy.listenPort, proxy.dst, up, down)
-	tcpLog.Debugf("connection from %s closed", downstream.RemoteAddr().String())
+	return up, down
+}
+
+// track counts a new connection to target and returns its start, untrack
+// ends it.
+func track(protocol, listenPort, target string) time.Time {
+	connectionsCount.WithLabelValues(protocol, listenPort, target).Inc()
+	activeConnections.WithLabelValues(protocol, listenPort, target).Inc()
+	return time.Now()
+}
+
+func untrack(protocol, listenPort, target string, start time.Time) {
+	activeConnections.WithLabelValues(protocol, listenPort, target).Dec()
+	connectionDuration.WithLabelValues(protocol, listenPort, target).Observe(time.Since(start).Seconds())
 }
 
 // recordBytes accounts the per-direction and per-connection byte metrics for a
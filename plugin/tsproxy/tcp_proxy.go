@@ -1,43 +1,68 @@
 package tsproxy
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/reuseport"
+
+	"github.com/pires/go-proxyproto"
 )
 
 type TcpProxyProxy struct {
 	listener   net.Listener
+	pool       *pool
 	wg         sync.WaitGroup
 	quit       chan any
-	dst        string
+	handover   chan any
 	protocol   string
 	listenPort string
+
+	// gate admits the clients allowed by the channel's access.
+	gate *gate
+	// accessLog logs every admitted connection, if set.
+	accessLog *accessLogger
+
+	// version of the PROXY protocol header, 1 or 2. With tlvs, the v2 header
+	// carries the server name and ALPN of the client's TLS ClientHello.
+	version byte
+	tlvs    bool
 }
 
-func NewTcpProxyProxy(protocol string, srcPort int, dstAddr string, dstPort int) *TcpProxyProxy {
+// NewTcpProxyProxy listens on the port of the tcp_proxy channel ch and
+// forwards its connections to the channel's targets behind a PROXY header.
+func NewTcpProxyProxy(d dialer, ch channel) (*TcpProxyProxy, error) {
 	var proxy TcpProxyProxy
 
-	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", srcPort))
+	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", ch.myPort))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	proxy.listener = listener
 	proxy.wg.Add(1)
-	proxy.dst = fmt.Sprintf("%s:%d", dstAddr, dstPort)
 	proxy.quit = make(chan any)
-	proxy.protocol = protocol
-	proxy.listenPort = strconv.Itoa(srcPort)
+	proxy.handover = make(chan any)
+	proxy.protocol = ch.protocol
+	proxy.listenPort = strconv.Itoa(ch.myPort)
+	proxy.listener = acceptProxy(listener, ch.protocol, proxy.listenPort, ch.access)
+	proxy.gate = newGate(ch.protocol, proxy.listenPort, ch.access)
+	proxy.pool = newPool(d, ch.protocol, proxy.listenPort, ch.targets, ch.balancing)
+	proxy.accessLog = ch.accessLog
+	proxy.version = 1
+	if ch.proxyV2 {
+		proxy.version = 2
+	}
+	proxy.tlvs = ch.proxyTLVs
 
-	tcpProxyLog.Infof("starting TCP+PROXY proxy from local port %d to %s", srcPort, proxy.dst)
+	tcpProxyLog.Infof("starting TCP+PROXY v%d proxy from local port %d to %s", proxy.version, ch.myPort, strings.Join(ch.targets, ", "))
 
 	go proxy.serve()
-	return &proxy
+	return &proxy, nil
 }
 
 func (proxy *TcpProxyProxy) serve() {
@@ -49,84 +74,111 @@ func (proxy *TcpProxyProxy) serve() {
 			select {
 			case <-proxy.quit:
 				return
+			case <-proxy.handover:
+				return
 			default:
 				tcpProxyLog.Errorf("accept error: %v", err)
 			}
 		} else {
-			connectionsCount.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Inc()
-			activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Inc()
 			proxy.wg.Go(func() {
 				proxy.handleConnection(conn)
 			})
-			tcpProxyLog.Debugf("incomming connection from '%s' will be proxied to '%s' with PROXY header", conn.RemoteAddr().String(), proxy.dst)
 		}
 	}
 }
 
+// Handover stops accepting connections, open ones continue until they end.
+func (proxy *TcpProxyProxy) Handover() {
+	close(proxy.handover)
+	proxy.listener.Close()
+	proxy.pool.stop()
+}
+
 func (proxy *TcpProxyProxy) Close() {
 	close(proxy.quit)
 	proxy.listener.Close()
+	proxy.pool.stop()
 	proxy.wg.Wait()
 }
 
 func (proxy *TcpProxyProxy) handleConnection(downstream net.Conn) {
 	defer downstream.Close()
 
-	start := time.Now()
-	defer func() {
-		activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Dec()
-		connectionDuration.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Observe(time.Since(start).Seconds())
-	}()
+	if err := readProxyHeader(downstream, proxy.protocol, proxy.listenPort); err != nil {
+		tcpProxyLog.Debugf("rejecting connection from %s: %v", downstream.RemoteAddr(), err)
+		return
+	}
+	release, ok := proxy.gate.admit(downstream.RemoteAddr())
+	if !ok {
+		return
+	}
+	defer release()
 
-	var upstream net.Conn
-	var err error
-	upstream, err = net.Dial("tcp", proxy.dst)
+	entry := newConnEntry(proxy.protocol, proxy.listenPort, downstream.RemoteAddr())
+	defer proxy.accessLog.write(entry)
 
+	upstream, b, err := proxy.pool.dial(context.Background(), "tcp")
 	if err != nil {
 		tcpProxyLog.Errorf("error dialing remote addr: %v", err)
+		entry.reason = closeDialError
+		rejectedCount.WithLabelValues(proxy.protocol, proxy.listenPort, closeDialError).Inc()
 		return
 	}
 	defer upstream.Close()
-
-	// Write PROXY protocol v1 header
-	srcAddr := downstream.RemoteAddr().(*net.TCPAddr)
-	dstAddr := downstream.LocalAddr().(*net.TCPAddr)
-	family := "TCP4"
-	if srcAddr.IP.To4() == nil {
-		family = "TCP6"
+	defer proxy.pool.release(b)
+	entry.target = b.addr
+	tcpProxyLog.Debugf("incoming connection from '%s' will be proxied to '%s' with PROXY header", downstream.RemoteAddr().String(), b.addr)
+
+	start := track(proxy.protocol, proxy.listenPort, b.addr)
+	defer untrack(proxy.protocol, proxy.listenPort, b.addr, start)
+
+	header := proxyproto.HeaderProxyFromAddrs(proxy.version, downstream.RemoteAddr(), downstream.LocalAddr())
+
+	// The TLVs come from the ClientHello, which is then replayed after the header.
+	var hello []byte
+	if proxy.tlvs {
+		downstream.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+		var info clientHello
+		info, hello, err = peekClientHello(downstream)
+		downstream.SetReadDeadline(time.Time{})
+		if err != nil {
+			tcpProxyLog.Debugf("no ClientHello from %s: %v", downstream.RemoteAddr(), err)
+		}
+		if err := header.SetTLVs(helloTLVs(info)); err != nil {
+			tcpProxyLog.Errorf("error setting proxy protocol TLVs: %v", err)
+			entry.reason = closeError
+			return
+		}
 	}
-	header := fmt.Sprintf("PROXY %s %s %s %d %d\r\n",
-		family, srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
-	if _, err := upstream.Write([]byte(header)); err != nil {
+
+	if _, err := header.WriteTo(upstream); err != nil {
 		tcpProxyLog.Errorf("error writing proxy protocol header: %v", err)
+		entry.reason = closeError
 		return
 	}
-
-	// Start threads for copying both ways
-	closerChannel := make(chan struct{})
-	defer close(closerChannel)
-
-	var up, down int64
-	var iowg sync.WaitGroup
-	iowg.Add(2)
-	go copy(&iowg, closerChannel, upstream, downstream, &up)   // client -> target
-	go copy(&iowg, closerChannel, downstream, upstream, &down) // target -> client
-
-	// Wait until one of:
-	//  - one thread ends
-	//  - a stop is requested from the outside
-	select {
-	case <-closerChannel:
-	case <-proxy.quit:
+	if _, err := upstream.Write(hello); err != nil {
+		tcpProxyLog.Errorf("error writing ClientHello: %v", err)
+		entry.reason = closeError
+		return
 	}
 
-	// and then close the connection after the drain timeout also for the other side, if they don't close it themselves
-	now := time.Now()
-	downstream.SetDeadline(now.Add(tcpDrainTimeout))
-	upstream.SetDeadline(now.Add(tcpDrainTimeout))
-
-	// wait for both copy threads to finish
-	iowg.Wait()
-	recordBytes(proxy.protocol, proxy.listenPort, proxy.dst, up, down)
+	up, down := pipe(proxy.quit, downstream, upstream)
+	up += int64(len(hello))
+	recordBytes(proxy.protocol, proxy.listenPort, b.addr, up, down)
+	entry.up, entry.down, entry.reason = up, down, closeReason(proxy.quit)
 	tcpProxyLog.Debugf("connection from %s closed", downstream.RemoteAddr().String())
 }
+
+// helloTLVs returns the PROXY v2 TLVs describing a ClientHello: the server
+// name as authority and the client's preferred ALPN protocol, as the target
+// can't know which one it will negotiate before the handshake.
+func helloTLVs(hello clientHello) []proxyproto.TLV {
+	var tlvs []proxyproto.TLV
+	if hello.serverName != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_AUTHORITY, Value: []byte(hello.serverName)})
+	}
+	if len(hello.protocols) > 0 {
+		tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.PP2_TYPE_ALPN, Value: []byte(hello.protocols[0])})
+	}
+	return tlvs
+}
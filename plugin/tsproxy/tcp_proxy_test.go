@@ -2,11 +2,15 @@ package tsproxy
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"regexp"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pires/go-proxyproto"
 )
 
 // proxyHeaderRE matches a PROXY protocol v1 header for an IPv4 loopback connection.
@@ -48,7 +52,10 @@ func TestTcpProxyProxyWritesProxyHeader(t *testing.T) {
 	}()
 
 	listenPort := freePort(t)
-	proxy := NewTcpProxyProxy("tcp_proxy", listenPort, "127.0.0.1", targetPort)
+	proxy, err := NewTcpProxyProxy(&recordingDialer{}, channel{protocol: "tcp_proxy", myPort: listenPort, targets: local(targetPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	t.Cleanup(proxy.Close)
 
 	conn := dialTCP(t, listenPort)
@@ -82,3 +89,73 @@ func TestTcpProxyProxyWritesProxyHeader(t *testing.T) {
 		t.Errorf("connectionsCount = %v, want >= 1", c)
 	}
 }
+
+func TestTcpProxyProxyV2TLVs(t *testing.T) {
+	headers := make(chan *proxyproto.Header, 1)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	targetPort := l.Addr().(*net.TCPAddr).Port
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		header, err := proxyproto.Read(bufio.NewReader(conn))
+		if err != nil {
+			t.Errorf("reading PROXY header: %v", err)
+			header = nil
+		}
+		headers <- header
+	}()
+
+	listenPort := freePort(t)
+	proxy, err := NewTcpProxyProxy(&recordingDialer{}, channel{protocol: "tcp_proxy", myPort: listenPort, targets: local(targetPort), proxyV2: true, proxyTLVs: true})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	conn := dialTCP(t, listenPort)
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	// The handshake fails once the target hangs up, only the ClientHello matters.
+	go tls.Client(conn, &tls.Config{ServerName: "service.example.org", NextProtos: []string{"h2", "http/1.1"}, InsecureSkipVerify: true}).Handshake() //nolint:gosec // no certificates involved
+
+	var header *proxyproto.Header
+	select {
+	case header = <-headers:
+	case <-time.After(2 * time.Second):
+		t.Fatal("did not receive PROXY header at target")
+	}
+	if header == nil {
+		t.FailNow()
+	}
+
+	if header.Version != 2 || header.TransportProtocol != proxyproto.TCPv4 {
+		t.Errorf("header version %d protocol %v, want 2 TCPv4", header.Version, header.TransportProtocol)
+	}
+	if src, _, ok := header.TCPAddrs(); !ok || src.String() != conn.LocalAddr().String() {
+		t.Errorf("source address = %v, want %v", src, conn.LocalAddr())
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatalf("parsing TLVs: %v", err)
+	}
+	got := map[proxyproto.PP2Type]string{}
+	for _, tlv := range tlvs {
+		got[tlv.Type] = string(tlv.Value)
+	}
+	want := map[proxyproto.PP2Type]string{
+		proxyproto.PP2_TYPE_AUTHORITY: "service.example.org",
+		proxyproto.PP2_TYPE_ALPN:      "h2",
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("TLVs mismatch (-want +got):\n%s", diff)
+	}
+}
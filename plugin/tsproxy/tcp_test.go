@@ -5,6 +5,8 @@ import (
 	"net"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestTcpProxyRoundtrip(t *testing.T) {
@@ -14,7 +16,11 @@ func TestTcpProxyRoundtrip(t *testing.T) {
 
 	before := metric(t, connectionsCount.WithLabelValues("tcp", itoa(listenPort), dst))
 
-	proxy := NewTcpProxy("tcp", listenPort, "127.0.0.1", echoPort)
+	d := &recordingDialer{}
+	proxy, err := NewTcpProxy(d, channel{protocol: "tcp", myPort: listenPort, targets: local(echoPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	t.Cleanup(proxy.Close)
 
 	conn := dialTCP(t, listenPort)
@@ -50,17 +56,27 @@ func TestTcpProxyRoundtrip(t *testing.T) {
 	if down < float64(len(payload)) {
 		t.Errorf("proxied down bytes = %v, want >= %d", down, len(payload))
 	}
+
+	// The upstream connection must go through the injected dialer.
+	if diff := cmp.Diff([]string{"tcp " + dst}, d.recorded()); diff != "" {
+		t.Errorf("dials mismatch (-want +got):\n%s", diff)
+	}
 }
 
 // TestTcpProxyDialFailure verifies that when the upstream is unreachable the
 // proxy still accepts and then cleanly closes the client connection, and the
-// active-connection gauge settles back to zero (no hang, no leak of accounting).
+// connection is counted as rejected rather than as one to the target.
 func TestTcpProxyDialFailure(t *testing.T) {
 	deadPort := freePort(t) // nothing listening here
 	listenPort := freePort(t)
 	dst := fmt.Sprintf("127.0.0.1:%d", deadPort)
+	rejected := rejectedCount.WithLabelValues("tcp", itoa(listenPort), closeDialError)
+	before := metric(t, rejected)
 
-	proxy := NewTcpProxy("tcp", listenPort, "127.0.0.1", deadPort)
+	proxy, err := NewTcpProxy(&recordingDialer{}, channel{protocol: "tcp", myPort: listenPort, targets: local(deadPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	t.Cleanup(proxy.Close)
 
 	conn := dialTCP(t, listenPort)
@@ -74,9 +90,15 @@ func TestTcpProxyDialFailure(t *testing.T) {
 	}
 
 	if !eventually(t, time.Second, func() bool {
-		return metric(t, activeConnections.WithLabelValues("tcp", itoa(listenPort), dst)) == 0
+		return metric(t, rejected) == before+1
 	}) {
-		t.Errorf("activeConnections did not return to 0 after dial failure")
+		t.Errorf("rejected dial_error = %v, want %v", metric(t, rejected), before+1)
+	}
+	if c := metric(t, connectionsCount.WithLabelValues("tcp", itoa(listenPort), dst)); c != 0 {
+		t.Errorf("connectionsCount = %v, want 0 after dial failure", c)
+	}
+	if a := metric(t, activeConnections.WithLabelValues("tcp", itoa(listenPort), dst)); a != 0 {
+		t.Errorf("activeConnections = %v, want 0 after dial failure", a)
 	}
 }
 
@@ -84,6 +106,9 @@ func TestTcpProxyDialFailure(t *testing.T) {
 
 func itoa(i int) string { return fmt.Sprintf("%d", i) }
 
+// local returns the targets of a single backend on the loopback port.
+func local(port int) []string { return []string{"127.0.0.1:" + itoa(port)} }
+
 func dialTCP(t *testing.T, port int) net.Conn {
 	t.Helper()
 	var conn net.Conn
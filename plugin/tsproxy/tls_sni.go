@@ -0,0 +1,255 @@
+package tsproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+)
+
+// sniPeekTimeout bounds how long a client may take to send its ClientHello.
+const sniPeekTimeout = 5 * time.Second
+
+// sniDefault is the pattern of the route taken when no other one matches.
+const sniDefault = "default"
+
+// sniRoute sends connections whose SNI matches pattern to its targets, given
+// as host:port. A pattern is a host name, a wildcard like *.example.org
+// matching any name below example.org, or sniDefault.
+type sniRoute struct {
+	pattern string
+	targets []string
+}
+
+// SniProxy routes TLS connections by the server name of their ClientHello,
+// without terminating TLS.
+type SniProxy struct {
+	listener   net.Listener
+	wg         sync.WaitGroup
+	quit       chan any
+	handover   chan any
+	routes     []sniRoute
+	pools      []*pool // of each route
+	protocol   string
+	listenPort string
+
+	// gate admits the clients allowed by the channel's access.
+	gate *gate
+	// accessLog logs every admitted connection, if set.
+	accessLog *accessLogger
+}
+
+// NewSniProxy listens on the port of the tls_sni channel ch and forwards its
+// connections to the targets of the route matching their server name.
+func NewSniProxy(d dialer, ch channel) (*SniProxy, error) {
+	var proxy SniProxy
+
+	listener, err := reuseport.Listen("tcp", fmt.Sprintf(":%d", ch.myPort))
+	if err != nil {
+		return nil, err
+	}
+
+	proxy.wg.Add(1)
+	proxy.routes = ch.routes
+	proxy.quit = make(chan any)
+	proxy.handover = make(chan any)
+	proxy.protocol = ch.protocol
+	proxy.listenPort = strconv.Itoa(ch.myPort)
+	proxy.listener = acceptProxy(listener, ch.protocol, proxy.listenPort, ch.access)
+	proxy.gate = newGate(ch.protocol, proxy.listenPort, ch.access)
+	proxy.accessLog = ch.accessLog
+	for _, r := range ch.routes {
+		proxy.pools = append(proxy.pools, newPool(d, ch.protocol, proxy.listenPort, r.targets, ch.balancing))
+	}
+
+	sniLog.Infof("starting TLS SNI proxy from local port %d with %d routes", ch.myPort, len(ch.routes))
+
+	go proxy.serve()
+	return &proxy, nil
+}
+
+func (proxy *SniProxy) serve() {
+	defer proxy.wg.Done()
+
+	for {
+		conn, err := proxy.listener.Accept()
+		if err != nil {
+			select {
+			case <-proxy.quit:
+				return
+			case <-proxy.handover:
+				return
+			default:
+				sniLog.Errorf("accept error: %v", err)
+			}
+		} else {
+			proxy.wg.Go(func() {
+				proxy.handleConnection(conn)
+			})
+		}
+	}
+}
+
+// Handover stops accepting connections, open ones continue until they end.
+func (proxy *SniProxy) Handover() {
+	close(proxy.handover)
+	proxy.listener.Close()
+	proxy.stopPools()
+}
+
+func (proxy *SniProxy) Close() {
+	close(proxy.quit)
+	proxy.listener.Close()
+	proxy.stopPools()
+	proxy.wg.Wait()
+}
+
+func (proxy *SniProxy) stopPools() {
+	for _, p := range proxy.pools {
+		p.stop()
+	}
+}
+
+func (proxy *SniProxy) handleConnection(downstream net.Conn) {
+	defer downstream.Close()
+
+	if err := readProxyHeader(downstream, proxy.protocol, proxy.listenPort); err != nil {
+		sniLog.Debugf("rejecting connection from %s: %v", downstream.RemoteAddr(), err)
+		return
+	}
+	release, ok := proxy.gate.admit(downstream.RemoteAddr())
+	if !ok {
+		return
+	}
+	defer release()
+
+	entry := newConnEntry(proxy.protocol, proxy.listenPort, downstream.RemoteAddr())
+	defer proxy.accessLog.write(entry)
+
+	downstream.SetReadDeadline(time.Now().Add(sniPeekTimeout))
+	info, hello, err := peekClientHello(downstream)
+	downstream.SetReadDeadline(time.Time{})
+	if err != nil {
+		sniLog.Debugf("no ClientHello from %s: %v", downstream.RemoteAddr(), err)
+	}
+	serverName := info.serverName
+
+	i, ok := matchSNI(proxy.routes, serverName)
+	if !ok {
+		sniLog.Debugf("no route for server name %q from %s", serverName, downstream.RemoteAddr())
+		entry.reason = closeNoRoute
+		rejectedCount.WithLabelValues(proxy.protocol, proxy.listenPort, closeNoRoute).Inc()
+		return
+	}
+	pool := proxy.pools[i]
+
+	upstream, b, err := pool.dial(context.Background(), "tcp")
+	if err != nil {
+		sniLog.Errorf("error dialing remote addr: %v", err)
+		entry.reason = closeDialError
+		rejectedCount.WithLabelValues(proxy.protocol, proxy.listenPort, closeDialError).Inc()
+		return
+	}
+	defer upstream.Close()
+	defer pool.release(b)
+	entry.target = b.addr
+	sniLog.Debugf("incoming connection from '%s' for %q will be proxied to '%s'", downstream.RemoteAddr(), serverName, b.addr)
+
+	start := track(proxy.protocol, proxy.listenPort, b.addr)
+	defer untrack(proxy.protocol, proxy.listenPort, b.addr, start)
+
+	// Replay the ClientHello, the target does the handshake.
+	if _, err := upstream.Write(hello); err != nil {
+		sniLog.Errorf("error writing ClientHello: %v", err)
+		entry.reason = closeError
+		return
+	}
+
+	up, down := pipe(proxy.quit, downstream, upstream)
+	up += int64(len(hello))
+	recordBytes(proxy.protocol, proxy.listenPort, b.addr, up, down)
+	entry.up, entry.down, entry.reason = up, down, closeReason(proxy.quit)
+	sniLog.Debugf("connection from %s closed", downstream.RemoteAddr().String())
+}
+
+// errHelloRead aborts the handshake once the ClientHello is parsed.
+var errHelloRead = errors.New("ClientHello read")
+
+// clientHello holds what the proxies use from a TLS ClientHello.
+type clientHello struct {
+	// serverName is the SNI, empty if the client sent none.
+	serverName string
+	// protocols are the ALPN protocols offered, in the client's preference.
+	protocols []string
+}
+
+// peekClientHello reads the ClientHello from conn and returns it with the
+// bytes read, which must be replayed to the target. It lets crypto/tls parse
+// the message on a connection that can only be read from, and aborts the
+// handshake right after.
+func peekClientHello(conn net.Conn) (clientHello, []byte, error) {
+	var raw bytes.Buffer
+	var hello clientHello
+	err := tls.Server(readOnlyConn{r: io.TeeReader(conn, &raw)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello.serverName = info.ServerName
+			hello.protocols = info.SupportedProtos
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	if errors.Is(err, errHelloRead) {
+		err = nil
+	}
+	return hello, raw.Bytes(), err
+}
+
+// readOnlyConn is a net.Conn that reads from r and fails all writes, so the
+// TLS server peeking the ClientHello can't answer the client.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// matchSNI returns the index of the route for serverName. An exact name wins over
+// wildcards, a longer wildcard over a shorter one, and the default route is
+// taken when nothing matches or the client sent no server name.
+func matchSNI(routes []sniRoute, serverName string) (int, bool) {
+	name := strings.TrimSuffix(strings.ToLower(serverName), ".")
+
+	best, fallback := -1, -1
+	bestLen := -1
+	for i, r := range routes {
+		switch {
+		case r.pattern == sniDefault:
+			fallback = i
+		case name == "":
+		case r.pattern == name:
+			return i, true
+		case strings.HasPrefix(r.pattern, "*."):
+			suffix := r.pattern[1:]
+			if strings.HasSuffix(name, suffix) && len(suffix) > bestLen {
+				best, bestLen = i, len(suffix)
+			}
+		}
+	}
+	if best >= 0 {
+		return best, true
+	}
+	return fallback, fallback >= 0
+}
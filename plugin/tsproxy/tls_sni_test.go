@@ -0,0 +1,118 @@
+package tsproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMatchSNI(t *testing.T) {
+	routes := []sniRoute{
+		{pattern: "*.example.org", targets: []string{"wildcard"}},
+		{pattern: "service.example.org", targets: []string{"exact"}},
+		{pattern: "*.internal.example.org", targets: []string{"internal"}},
+		{pattern: sniDefault, targets: []string{"default"}},
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"service.example.org", "exact"},
+		{"SERVICE.example.org.", "exact"},
+		{"other.example.org", "wildcard"},
+		{"db.internal.example.org", "internal"},
+		{"a.b.example.org", "wildcard"},
+		{"example.org", "default"},
+		{"example.com", "default"},
+		{"", "default"},
+	}
+	for _, tc := range tests {
+		i, ok := matchSNI(routes, tc.serverName)
+		if !ok || routes[i].targets[0] != tc.want {
+			t.Errorf("matchSNI(%q) = %d, %v, want %q", tc.serverName, i, ok, tc.want)
+		}
+	}
+
+	if _, ok := matchSNI(routes[:3], "example.com"); ok {
+		t.Error("expected no route without a default")
+	}
+}
+
+// sniTarget starts a TCP server that reads the ClientHello replayed by the
+// proxy and reports its server name. It returns the port.
+func sniTarget(t *testing.T, names chan<- string) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("sniTarget listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			hello, _, err := peekClientHello(conn)
+			name := hello.serverName
+			if err != nil {
+				name = "error: " + err.Error()
+			}
+			names <- name
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestSniProxyRoutes(t *testing.T) {
+	exact, fallback := make(chan string, 1), make(chan string, 1)
+	exactPort, fallbackPort := sniTarget(t, exact), sniTarget(t, fallback)
+	listenPort := freePort(t)
+
+	d := &recordingDialer{}
+	proxy, err := NewSniProxy(d, channel{protocol: "tls_sni", myPort: listenPort, routes: []sniRoute{
+		{pattern: "service.example.org", targets: local(exactPort)},
+		{pattern: sniDefault, targets: local(fallbackPort)},
+	}})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	tests := []struct {
+		serverName string
+		target     chan string
+	}{
+		{"service.example.org", exact},
+		{"unknown.example.org", fallback},
+	}
+	for _, tc := range tests {
+		conn := dialTCP(t, listenPort)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		// The handshake fails once the target hangs up, only the ClientHello matters.
+		go tls.Client(conn, &tls.Config{ServerName: tc.serverName, InsecureSkipVerify: true}).Handshake() //nolint:gosec // no certificates involved
+
+		select {
+		case got := <-tc.target:
+			if got != tc.serverName {
+				t.Errorf("target got server name %q, want %q", got, tc.serverName)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("no connection for %q at the expected target", tc.serverName)
+		}
+		conn.Close()
+	}
+
+	dst := fmt.Sprintf("127.0.0.1:%d", exactPort)
+	if !eventually(t, time.Second, func() bool {
+		return metric(t, connectionsCount.WithLabelValues("tls_sni", itoa(listenPort), dst)) == 1
+	}) {
+		t.Errorf("connectionsCount for %s did not reach 1", dst)
+	}
+}
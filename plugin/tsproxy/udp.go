@@ -1,13 +1,20 @@
 package tsproxy
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/reuseport"
+
+	"github.com/pires/go-proxyproto"
 )
 
 // udpIdleTimeout is how long a UDP session may stay idle before it is garbage
@@ -19,8 +26,9 @@ const (
 
 type UdpProxy struct {
 	srcPort    int
-	dst        string
+	pool       *pool
 	quit       chan struct{}
+	closeOnce  sync.Once
 	protocol   string
 	listenPort string
 
@@ -31,52 +39,77 @@ type UdpProxy struct {
 
 	downstream downstreamProxy
 	upstream   map[string]*upstreamProxy
+
+	// gate admits the clients allowed by the channel's access.
+	gate *gate
+	// accessLog logs every session of an admitted client, if set.
+	accessLog *accessLogger
+
+	// proxyHeader prefixes every datagram sent upstream with a PROXY
+	// protocol v2 header (udp_proxy).
+	proxyHeader bool
+
+	listener *net.UDPConn
 }
 
-// newUdpProxy builds an unstarted UdpProxy with default settings. It is split
-// from NewUdpProxy so tests can tweak fields (e.g. idleTimeout/gcInterval)
-// before serve() reads them.
-func newUdpProxy(protocol string, srcPort int, dstAddr string, dstPort int) *UdpProxy {
+// newUdpProxy binds the listener of an unstarted UdpProxy with default
+// settings. It is split from NewUdpProxy so tests can tweak fields (e.g.
+// idleTimeout/gcInterval) before serve() reads them.
+func newUdpProxy(d dialer, ch channel) (*UdpProxy, error) {
 	var proxy UdpProxy
 
-	proxy.srcPort = srcPort
-	proxy.dst = fmt.Sprintf("%s:%d", dstAddr, dstPort)
+	// SO_REUSEPORT lets a reloaded instance bind the port before this one
+	// lets go of it
+	pc, err := reuseport.ListenPacket("udp", fmt.Sprintf(":%d", ch.myPort))
+	if err != nil {
+		return nil, err
+	}
+	proxy.listener = pc.(*net.UDPConn)
+
+	proxy.srcPort = ch.myPort
 	proxy.quit = make(chan struct{})
-	proxy.protocol = protocol
-	proxy.listenPort = strconv.Itoa(srcPort)
+	proxy.protocol = ch.protocol
+	proxy.listenPort = strconv.Itoa(ch.myPort)
 	proxy.idleTimeout = udpIdleTimeout
 	proxy.gcInterval = udpGCInterval
+	proxy.proxyHeader = ch.protocol == "udp_proxy"
+	proxy.gate = newGate(ch.protocol, proxy.listenPort, ch.access)
+	proxy.pool = newPool(d, ch.protocol, proxy.listenPort, ch.targets, ch.balancing)
+	proxy.accessLog = ch.accessLog
 
-	return &proxy
+	return &proxy, nil
 }
 
-func NewUdpProxy(protocol string, srcPort int, dstAddr string, dstPort int) *UdpProxy {
-	proxy := newUdpProxy(protocol, srcPort, dstAddr, dstPort)
+// NewUdpProxy listens on the port of the udp or udp_proxy channel ch and
+// forwards its datagrams to the channel's targets.
+func NewUdpProxy(d dialer, ch channel) (*UdpProxy, error) {
+	proxy, err := newUdpProxy(d, ch)
+	if err != nil {
+		return nil, err
+	}
 
-	udpLog.Infof("starting UDP proxy from local port %d to %s", proxy.srcPort, proxy.dst)
+	kind := "UDP"
+	if proxy.proxyHeader {
+		kind = "UDP+PROXY v2"
+	}
+	udpLog.Infof("starting %s proxy from local port %d to %s", kind, proxy.srcPort, strings.Join(ch.targets, ", "))
 
 	go proxy.serve()
-	return proxy
+	return proxy, nil
 }
 
 func (proxy *UdpProxy) serve() {
-	// open downstream listener
-	listener, err := net.ListenUDP("udp", &net.UDPAddr{Port: proxy.srcPort})
-	if err != nil {
-		panic(err)
-	}
-
 	// prepare upstream
 	proxy.upstream = make(map[string]*upstreamProxy)
 	defer func() {
 		for key, ch := range proxy.upstream {
-			ch.close()
+			ch.close(closeShutdown)
 			delete(proxy.upstream, key)
 		}
 	}()
 
 	// start downstream
-	proxy.downstream.in = listener
+	proxy.downstream.in = proxy.listener
 	proxy.downstream.toDownstream = make(chan msg)
 	proxy.downstream.toUpstream = make(chan msg)
 	proxy.downstream.start()
@@ -87,7 +120,7 @@ func (proxy *UdpProxy) serve() {
 		deadline := now.Add(-proxy.idleTimeout)
 		for key, ch := range proxy.upstream {
 			if time.Unix(0, ch.lastUsed.Load()).Before(deadline) {
-				ch.close()
+				ch.close(closeIdle)
 				delete(proxy.upstream, key)
 			}
 		}
@@ -116,20 +149,25 @@ func (proxy *UdpProxy) send(m msg) {
 	up, ok := proxy.upstream[m.addr.String()]
 
 	if !ok {
-		var conn *net.UDPConn
-		var err error
-
-		addr, err := net.ResolveUDPAddr("udp", proxy.dst)
-		if err != nil {
-			udpLog.Errorf("failed to resolve target UDP address '%v' of the proxy: %v", proxy.dst, err)
+		// Datagrams of rejected clients are dropped, every one counts.
+		admitted, ok := proxy.gate.admit(m.addr)
+		if !ok {
 			return
 		}
-
-		conn, err = net.DialUDP("udp", nil, addr)
+		conn, b, err := proxy.pool.dial(context.Background(), "udp")
 		if err != nil {
 			udpLog.Errorf("udp dial error: %v", err)
+			admitted()
+			entry := newConnEntry(proxy.protocol, proxy.listenPort, m.addr)
+			entry.reason = closeDialError
+			proxy.accessLog.write(entry)
+			rejectedCount.WithLabelValues(proxy.protocol, proxy.listenPort, closeDialError).Inc()
 			return
 		}
+		release := func() {
+			admitted()
+			proxy.pool.release(b)
+		}
 
 		newUpstream := &upstreamProxy{
 			toDownstream:      proxy.downstream.toDownstream,
@@ -138,13 +176,28 @@ func (proxy *UdpProxy) send(m msg) {
 			downstreamAddress: m.addr,
 			protocol:          proxy.protocol,
 			listenPort:        proxy.listenPort,
-			target:            proxy.dst,
+			target:            b.addr,
+			release:           release,
+			accessLog:         proxy.accessLog,
+		}
+		if proxy.proxyHeader {
+			header, err := proxy.header(m.addr)
+			if err != nil {
+				udpLog.Errorf("building PROXY header for %s: %v", m.addr, err)
+				conn.Close()
+				release()
+				entry := newConnEntry(proxy.protocol, proxy.listenPort, m.addr)
+				entry.target, entry.reason = b.addr, closeError
+				proxy.accessLog.write(entry)
+				return
+			}
+			newUpstream.header = header
 		}
 		newUpstream.start()
 		proxy.upstream[m.addr.String()] = newUpstream
 
-		connectionsCount.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Inc()
-		activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.dst).Inc()
+		connectionsCount.WithLabelValues(proxy.protocol, proxy.listenPort, b.addr).Inc()
+		activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, b.addr).Inc()
 
 		up = newUpstream
 	}
@@ -152,6 +205,17 @@ func (proxy *UdpProxy) send(m msg) {
 	up.toUpstream <- m
 }
 
+// header returns the PROXY protocol v2 header of a session from src. The
+// listener is bound to the unspecified address, so the destination is the
+// unspecified address of the source's family and the listen port.
+func (proxy *UdpProxy) header(src *net.UDPAddr) ([]byte, error) {
+	dst := &net.UDPAddr{IP: net.IPv6unspecified, Port: proxy.srcPort}
+	if src.IP.To4() != nil {
+		dst.IP = net.IPv4zero
+	}
+	return proxyproto.HeaderProxyFromAddrs(2, src, dst).Format()
+}
+
 type msg struct {
 	data []byte
 	addr *net.UDPAddr
@@ -215,7 +279,7 @@ type upstreamProxy struct {
 	toDownstream      chan msg
 	toUpstream        chan msg
 	quit              chan struct{}
-	conn              *net.UDPConn
+	conn              net.Conn
 	downstreamAddress *net.UDPAddr
 	lastUsed          atomic.Int64 // unix-nanos; accessed concurrently by reader/writer/GC
 
@@ -225,6 +289,13 @@ type upstreamProxy struct {
 	created    time.Time
 	bytesUp    atomic.Int64 // client -> target
 	bytesDown  atomic.Int64 // target -> client
+
+	// header is sent in front of every datagram to the target, if set.
+	header []byte
+	// release frees the session's slot in the gate.
+	release func()
+	// accessLog logs the session when it is closed, if set.
+	accessLog *accessLogger
 }
 
 func (proxy *upstreamProxy) reader() {
@@ -233,7 +304,7 @@ func (proxy *upstreamProxy) reader() {
 	for {
 		proxy.lastUsed.Store(time.Now().UnixNano())
 		buffer := make([]byte, 16*1024)
-		n, _, _, _, err := proxy.conn.ReadMsgUDP(buffer, nil)
+		n, err := proxy.conn.Read(buffer)
 		if n > 0 {
 			proxy.bytesDown.Add(int64(n))
 			proxiedBytesCount.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.target, directionDown).Add(float64(n))
@@ -257,7 +328,13 @@ func (proxy *upstreamProxy) writer() {
 			proxy.conn.SetDeadline(time.Now())
 			return
 		case pkt := <-proxy.toUpstream:
-			n, _, err := proxy.conn.WriteMsgUDP(pkt.data, nil, nil)
+			data := pkt.data
+			if proxy.header != nil {
+				data = append(proxy.header[:len(proxy.header):len(proxy.header)], pkt.data...)
+			}
+			n, err := proxy.conn.Write(data)
+			// only the payload counts, not the header
+			n = max(n-len(proxy.header), 0)
 			if n > 0 {
 				proxy.bytesUp.Add(int64(n))
 				proxiedBytesCount.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.target, directionUp).Add(float64(n))
@@ -282,8 +359,20 @@ func (proxy *upstreamProxy) start() {
 	go proxy.writer()
 }
 
-func (proxy *upstreamProxy) close() {
+// close ends the session, reason is logged as why.
+func (proxy *upstreamProxy) close(reason string) {
 	close(proxy.quit)
+	proxy.release()
+	proxy.accessLog.write(&connEntry{
+		remote:     proxy.downstreamAddress,
+		channel:    proxy.protocol,
+		listenPort: proxy.listenPort,
+		target:     proxy.target,
+		start:      proxy.created,
+		up:         proxy.bytesUp.Load(),
+		down:       proxy.bytesDown.Load(),
+		reason:     reason,
+	})
 
 	activeConnections.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.target).Dec()
 	connectionDuration.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.target).Observe(time.Since(proxy.created).Seconds())
@@ -291,6 +380,13 @@ func (proxy *upstreamProxy) close() {
 	connectionBytes.WithLabelValues(proxy.protocol, proxy.listenPort, proxy.target).Observe(float64(total))
 }
 
+// Handover stops the proxy. Sessions can't outlive the listener they answer
+// through, clients' next datagrams start new sessions in the new instance.
+func (proxy *UdpProxy) Handover() {
+	proxy.Close()
+}
+
 func (proxy *UdpProxy) Close() {
-	close(proxy.quit)
+	proxy.closeOnce.Do(func() { close(proxy.quit) })
+	proxy.pool.stop()
 }
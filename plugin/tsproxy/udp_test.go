@@ -1,10 +1,15 @@
 package tsproxy
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"net"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/pires/go-proxyproto"
 )
 
 // dialUDP opens a UDP socket connected to the proxy's listen port.
@@ -44,7 +49,10 @@ func TestUdpProxyRoundtrip(t *testing.T) {
 	listenPort := freePort(t)
 	dst := fmt.Sprintf("127.0.0.1:%d", echoPort)
 
-	proxy := NewUdpProxy("udp", listenPort, "127.0.0.1", echoPort)
+	proxy, err := NewUdpProxy(&recordingDialer{}, channel{protocol: "udp", myPort: listenPort, targets: local(echoPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	t.Cleanup(proxy.Close)
 
 	conn := dialUDP(t, listenPort)
@@ -72,7 +80,11 @@ func TestUdpProxySessionReuse(t *testing.T) {
 
 	before := metric(t, connectionsCount.WithLabelValues("udp", itoa(listenPort), dst))
 
-	proxy := NewUdpProxy("udp", listenPort, "127.0.0.1", echoPort)
+	d := &recordingDialer{}
+	proxy, err := NewUdpProxy(d, channel{protocol: "udp", myPort: listenPort, targets: local(echoPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	t.Cleanup(proxy.Close)
 
 	conn := dialUDP(t, listenPort)
@@ -87,6 +99,9 @@ func TestUdpProxySessionReuse(t *testing.T) {
 	if a := metric(t, activeConnections.WithLabelValues("udp", itoa(listenPort), dst)); a != 1 {
 		t.Errorf("activeConnections = %v, want 1", a)
 	}
+	if diff := cmp.Diff([]string{"udp " + dst}, d.recorded()); diff != "" {
+		t.Errorf("dials mismatch (-want +got):\n%s", diff)
+	}
 }
 
 // TestUdpProxyGCEviction uses a tiny idle timeout so the GC sweep evicts an idle
@@ -96,7 +111,10 @@ func TestUdpProxyGCEviction(t *testing.T) {
 	listenPort := freePort(t)
 	dst := fmt.Sprintf("127.0.0.1:%d", echoPort)
 
-	proxy := newUdpProxy("udp", listenPort, "127.0.0.1", echoPort)
+	proxy, err := newUdpProxy(&recordingDialer{}, channel{protocol: "udp", myPort: listenPort, targets: local(echoPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
 	proxy.idleTimeout = 20 * time.Millisecond
 	proxy.gcInterval = 10 * time.Millisecond
 	go proxy.serve()
@@ -113,3 +131,64 @@ func TestUdpProxyGCEviction(t *testing.T) {
 		t.Errorf("idle UDP session was not garbage collected")
 	}
 }
+
+func TestUdpProxyProxyHeader(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	targetPort := target.LocalAddr().(*net.UDPAddr).Port
+
+	listenPort := freePort(t)
+	proxy, err := NewUdpProxy(&recordingDialer{}, channel{protocol: "udp_proxy", myPort: listenPort, targets: local(targetPort)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(proxy.Close)
+
+	conn := dialUDP(t, listenPort)
+	t.Cleanup(func() { conn.Close() })
+
+	payload := []byte("udp ping")
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("udp write: %v", err)
+	}
+	buf := make([]byte, 64*1024)
+	target.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := target.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no datagram at target: %v", err)
+	}
+
+	header, err := proxyproto.Read(bufio.NewReader(bytes.NewReader(buf[:n])))
+	if err != nil {
+		t.Fatalf("reading PROXY header: %v", err)
+	}
+	src, dst, ok := header.UDPAddrs()
+	if !ok || header.Version != 2 {
+		t.Fatalf("header version %d protocol %v, want 2 UDPv4", header.Version, header.TransportProtocol)
+	}
+	if src.String() != conn.LocalAddr().String() || dst.Port != listenPort {
+		t.Errorf("header addresses %v -> %v, want %v -> :%d", src, dst, conn.LocalAddr(), listenPort)
+	}
+	raw, _ := header.Format()
+	if got := buf[len(raw):n]; !bytes.Equal(got, payload) {
+		t.Errorf("payload = %q, want %q", got, payload)
+	}
+
+	// Replies go back without a header.
+	if _, err := target.WriteToUDP([]byte("pong"), from); err != nil {
+		t.Fatalf("udp write: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("reply = %q, %v, want pong", buf[:n], err)
+	}
+
+	if !eventually(t, time.Second, func() bool {
+		return metric(t, proxiedBytesCount.WithLabelValues("udp_proxy", itoa(listenPort), fmt.Sprintf("127.0.0.1:%d", targetPort), directionUp)) == float64(len(payload))
+	}) {
+		t.Error("bytes up should count the payload only")
+	}
+}